@@ -1,86 +1,111 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"strconv"
+	"maps"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/stenstromen/outlinewikibackup/types"
 )
 
 const (
-	exportEndpoint   = "/api/collections.export_all"
-	progressEndpoint = "/api/fileOperations.info"
-	downloadEndpoint = "/api/fileOperations.redirect"
-	deleteEndpoint   = "/api/fileOperations.delete"
+	exportEndpoint             = "/api/collections.export_all"
+	collectionExportEndpoint   = "/api/collections.export"
+	collectionsListEndpoint    = "/api/collections.list"
+	progressEndpoint           = "/api/fileOperations.info"
+	downloadEndpoint           = "/api/fileOperations.redirect"
+	deleteEndpoint             = "/api/fileOperations.delete"
+	fileOperationsListEndpoint = "/api/fileOperations.list"
+	authInfoEndpoint           = "/api/auth.info"
 )
 
-var apiBaseURL string
+const pageSize = 100
 
-func init() {
-	var ok bool
-	apiBaseURL, ok = os.LookupEnv("API_BASE_URL")
-	if !ok {
-		log.Fatal("API_BASE_URL environment variable is not set.")
-	}
+const (
+	FormatMarkdown = "outline-markdown"
+	FormatHTML     = "html"
+	FormatJSON     = "json"
+)
 
-	_, err := url.ParseRequestURI(apiBaseURL)
-	if err != nil {
-		log.Fatalf("API_BASE_URL is not a valid URL: %v", err)
-	}
+var formatNames = map[string]string{
+	"markdown":         FormatMarkdown,
+	"md":               FormatMarkdown,
+	"outline-markdown": FormatMarkdown,
+	"html":             FormatHTML,
+	"json":             FormatJSON,
 }
 
-func makeAPIRequest(endpoint string, payload map[string]string) (resp *http.Response, err error) {
-	authToken := os.Getenv("AUTH_TOKEN")
+const (
+	StateComplete = "complete"
+	StateError    = "error"
+	StateExpired  = "expired"
+)
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		log.Println("Error marshalling payload:", err)
-		return nil, err
+// ParseFormats turns a comma separated list such as "json,html" into the
+// export formats understood by Outline, dropping duplicates.
+func ParseFormats(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return []string{FormatMarkdown}, nil
 	}
 
-	req, err := http.NewRequest("POST", apiBaseURL+endpoint, bytes.NewBuffer(body))
-	if err != nil {
-		log.Println("Error creating request:", err)
-		return nil, err
+	var formats []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		format, ok := formatNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown export format %q (expected markdown, html or json)", name)
+		}
+		if !seen[format] {
+			seen[format] = true
+			formats = append(formats, format)
+		}
 	}
 
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no export format given")
+	}
+	return formats, nil
+}
 
-	// Use a more robust HTTP client with better timeout handling
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
-		},
+// FormatLabel returns the short name of an export format used in archive names.
+func FormatLabel(format string) string {
+	if format == FormatMarkdown {
+		return "markdown"
 	}
+	return format
+}
 
-	resp, err = client.Do(req)
-	if err != nil {
-		log.Println("Error sending request:", err)
-		return nil, err
+// InitiateExport asks Outline to export all collections in the given format
+// and returns the ID of the resulting file operation.
+func (c *Client) InitiateExport(ctx context.Context, format string) (string, error) {
+	payload := map[string]any{
+		"format": format,
 	}
 
-	return resp, nil
+	return c.startExport(ctx, exportEndpoint, payload, format)
 }
 
-func InitiateExport() (string, error) {
-	payload := map[string]string{
-		"format": "outline-markdown",
+// InitiateCollectionExport asks Outline to export a single collection in the
+// given format and returns the ID of the resulting file operation.
+func (c *Client) InitiateCollectionExport(ctx context.Context, collectionID, format string) (string, error) {
+	payload := map[string]any{
+		"id":     collectionID,
+		"format": format,
 	}
 
-	resp, err := makeAPIRequest(exportEndpoint, payload)
+	return c.startExport(ctx, collectionExportEndpoint, payload, format)
+}
+
+func (c *Client) startExport(ctx context.Context, endpoint string, payload map[string]any, format string) (string, error) {
+	resp, err := c.makeAPIRequest(ctx, endpoint, payload)
 	if err != nil {
 		return "", err
 	}
@@ -88,126 +113,216 @@ func InitiateExport() (string, error) {
 
 	var exportResp types.ExportResponse
 	if err := json.NewDecoder(resp.Body).Decode(&exportResp); err != nil {
-		log.Println("Error decoding response:", err)
+		c.logger.Println("Error decoding response:", err)
 		return "", err
 	}
 
 	if !exportResp.Success {
-		log.Println("Failed to initiate export")
+		c.logger.Println("Failed to initiate export")
 		return "", fmt.Errorf("failed to initiate export")
 	}
 
+	// Older Outline versions don't report the format, so only a different one
+	// is an error
+	if got := exportResp.Data.FileOperation.Format; got != "" && got != format {
+		c.logger.Printf("Export format mismatch: requested %q, server reported %q", format, got)
+		return "", fmt.Errorf("export format mismatch: requested %q, got %q", format, got)
+	}
+
 	return exportResp.Data.FileOperation.ID, nil
 }
 
-func WaitForExportCompletion(exportID string) error {
-	for {
-		defaultSleepDuration := 10
-		sleepEnv := os.Getenv("SLEEP_DURATION")
-		sleepDuration, err := strconv.Atoi(sleepEnv)
-		if err != nil {
-			sleepDuration = defaultSleepDuration
-		}
-		time.Sleep(time.Duration(sleepDuration) * time.Second)
+// WaitForExportCompletion polls the file operation until it completes, fails
+// or Options.ExportTimeout passes.
+func (c *Client) WaitForExportCompletion(ctx context.Context, exportID string) error {
+	interval := c.opts.PollInterval
+	maxInterval := c.opts.MaxPollInterval
+	timeout := c.opts.ExportTimeout
 
-		reqBody := map[string]string{
-			"id": exportID,
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := jitter(interval)
+		if remaining := time.Until(deadline); wait > remaining {
+			wait = remaining
 		}
-
-		resp, err := makeAPIRequest(progressEndpoint, reqBody)
-		if err != nil {
+		if err := sleep(ctx, wait); err != nil {
 			return err
 		}
-		defer resp.Body.Close()
 
-		var progressResp types.ProgressResponse
-		if err := json.NewDecoder(resp.Body).Decode(&progressResp); err != nil {
-			log.Println("Error decoding response:", err)
+		progress, err := c.getExportProgress(ctx, exportID)
+		if err != nil {
 			return err
 		}
 
-		log.Println("Export state:", progressResp.Data.State)
+		state := progress.Data.State
+		c.logger.Println("Export state:", state)
 
-		if progressResp.Data.State == "complete" {
+		switch state {
+		case StateComplete:
 			return nil
+		case StateError, StateExpired:
+			msg := progress.Data.Error
+			if msg == "" {
+				msg = "no error message provided"
+			}
+			c.logger.Printf("Export %s ended in state %q: %s", exportID, state, msg)
+			return fmt.Errorf("export %s ended in state %q: %s", exportID, state, msg)
 		}
 
-		log.Println("Export is still in progress, waiting...")
+		if !time.Now().Before(deadline) {
+			c.logger.Println("Export did not complete within", timeout)
+			return fmt.Errorf("export %s did not complete within %s (last state %q)", exportID, timeout, state)
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+		c.logger.Println("Export is still in progress, waiting...")
 	}
 }
 
-func FetchAndSaveExport(exportID string) (string, error) {
-	reqBody := map[string]string{
+func (c *Client) getExportProgress(ctx context.Context, exportID string) (types.ProgressResponse, error) {
+	var progressResp types.ProgressResponse
+
+	reqBody := map[string]any{
 		"id": exportID,
 	}
 
-	resp, err := makeAPIRequest(downloadEndpoint, reqBody)
+	err := c.postJSON(ctx, progressEndpoint, reqBody, &progressResp)
+	return progressResp, err
+}
+
+// postJSON sends payload to endpoint and decodes the JSON response into v.
+func (c *Client) postJSON(ctx context.Context, endpoint string, payload map[string]any, v any) error {
+	resp, err := c.makeAPIRequest(ctx, endpoint, payload)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Println("Failed to get export file")
-		return "", fmt.Errorf("failed to get export file")
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		c.logger.Println("Error decoding response:", err)
+		return err
 	}
 
-	parsedURL, err := url.Parse(apiBaseURL)
-	if err != nil {
-		log.Println("Error parsing API_BASE_URL:", err)
-		return "", err
-	}
-	hostname := parsedURL.Hostname()
-	currentTime := time.Now().Format(time.RFC3339)
-	filename := fmt.Sprintf("%s-outline-backup-%s.zip", hostname, currentTime)
+	return nil
+}
 
-	saveDir := os.Getenv("SAVE_DIR")
-	if saveDir == "" {
-		saveDir = "/tmp/outlinewikibackups"
-	}
+// listAll follows the offset pagination of an Outline list endpoint and
+// returns the items of every page.
+func listAll[T any](ctx context.Context, c *Client, endpoint string, params map[string]any) ([]T, error) {
+	var items []T
+
+	offset := 0
+	for {
+		payload := maps.Clone(params)
+		if payload == nil {
+			payload = make(map[string]any)
+		}
+		payload["offset"] = offset
+		payload["limit"] = pageSize
+
+		var page struct {
+			Data       []T `json:"data"`
+			Pagination struct {
+				Limit int `json:"limit"`
+			} `json:"pagination"`
+		}
+		if err := c.postJSON(ctx, endpoint, payload, &page); err != nil {
+			return nil, err
+		}
 
-	fullPath := filepath.Join(saveDir, filename)
+		items = append(items, page.Data...)
+		offset += len(page.Data)
 
-	if err := os.MkdirAll(saveDir, os.ModePerm); err != nil {
-		log.Println("Error creating save directory:", err)
-		return "", err
+		// The server may cap the page size below what we asked for
+		limit := pageSize
+		if page.Pagination.Limit > 0 {
+			limit = min(limit, page.Pagination.Limit)
+		}
+		if len(page.Data) < limit {
+			return items, nil
+		}
 	}
+}
 
-	out, err := os.Create(fullPath)
-	if err != nil {
-		log.Println("Error creating file:", err)
-		return "", err
+// ArchiveName returns the file name for an export archive. Collection
+// exports carry the collection slug and URL ID so they can be told apart.
+func (c *Client) ArchiveName(format string, collection *types.Collection) string {
+	currentTime := time.Now().Format(time.RFC3339)
+	if collection == nil {
+		return fmt.Sprintf("%s-outline-backup-%s-%s.zip", c.Hostname(), FormatLabel(format), currentTime)
 	}
-	defer out.Close()
+	return fmt.Sprintf("%s-outline-backup-%s-%s-%s-%s.zip", c.Hostname(), FormatLabel(format), Slugify(collection.Name), collection.URLID, currentTime)
+}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		log.Println("Error saving file:", err)
-		return "", err
+// ArchivePattern matches the names ArchiveName returns for this Outline
+// instance, encrypted or not, so that retention leaves other files alone.
+// Names from before the format was part of them, such as
+// "<host>-outline-backup-<time>.zip", match too.
+func (c *Client) ArchivePattern() *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(c.Hostname()) + `-outline-backup-(?:(?:markdown|html|json)-.+|` + archiveTimeFormat + `)\.zip(\.age|\.gpg)?$`)
+}
+
+// archiveTimeFormat matches the RFC 3339 time ArchiveName puts into names.
+const archiveTimeFormat = `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:Z|[+-]\d{2}:\d{2})`
+
+var (
+	archiveTimePattern   = regexp.MustCompile(`-(` + archiveTimeFormat + `)\.zip(?:\.age|\.gpg)?$`)
+	archiveSeriesPattern = regexp.MustCompile(`-outline-backup-(?:([a-z]+)(?:-.*-([A-Za-z0-9]+))?-)?` + archiveTimeFormat + `\.zip(?:\.age|\.gpg)?$`)
+)
+
+// ArchiveSeries returns the format and the collection's URL ID that
+// ArchiveName put into name, such as "markdown" or "json-a1b2c3". The slug of
+// the collection is left out, so renaming a collection keeps its series.
+// Archives of a series are copies of the same data taken at different times.
+// Names from before the format was part of them are the series "".
+func ArchiveSeries(name string) (string, bool) {
+	m := archiveSeriesPattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
 	}
+	if m[2] == "" {
+		return m[1], true
+	}
+	return m[1] + "-" + m[2], true
+}
 
-	log.Println("File saved as:", fullPath)
+// IsCollectionArchive reports whether name is that of an archive
+// ArchiveName made for a single collection.
+func IsCollectionArchive(name string) bool {
+	series, ok := ArchiveSeries(name)
+	// Format labels don't contain a dash, so one separates the collection
+	return ok && strings.Contains(series, "-")
+}
 
-	return fullPath, nil
+// ArchiveTime returns the time ArchiveName put into name.
+func ArchiveTime(name string) (time.Time, bool) {
+	m := archiveTimePattern.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, m[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
 }
 
-func DeleteExport(exportID string) error {
-	reqBody := map[string]string{
+// DeleteExport removes the file operation and its archive from the server.
+func (c *Client) DeleteExport(ctx context.Context, exportID string) error {
+	reqBody := map[string]any{
 		"id": exportID,
 	}
 
-	resp, err := makeAPIRequest(deleteEndpoint, reqBody)
+	resp, err := c.makeAPIRequest(ctx, deleteEndpoint, reqBody)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Println("Failed to delete export")
-		return fmt.Errorf("failed to delete export")
-	}
-
-	log.Println("Export deletion response received")
+	c.logger.Println("Export deletion response received")
 
 	return nil
 }
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+func TestInitiateExportChecksFormat(t *testing.T) {
+	tests := []struct {
+		reported string
+		ok       bool
+	}{
+		{FormatJSON, true},
+		// Older Outline versions leave the format out
+		{"", true},
+		{FormatHTML, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.reported), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"success": true, "data": {"fileOperation": {"id": "op-1", "format": %q}}}`, tt.reported)
+			}))
+			defer server.Close()
+			c, err := NewClient(Options{BaseURL: server.URL, Token: "test-token", Logger: log.New(io.Discard, "", 0)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := c.InitiateExport(context.Background(), FormatJSON)
+			if (err == nil) != tt.ok {
+				t.Fatalf("InitiateExport() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && id != "op-1" {
+				t.Errorf("InitiateExport() = %q, want op-1", id)
+			}
+		})
+	}
+}
+
+func TestArchiveSeries(t *testing.T) {
+	c, err := NewClient(Options{BaseURL: "https://wiki.example.com", Token: "test-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineering := &types.Collection{Name: "Engineering & Ops", URLID: "eng8h2KdLq"}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{c.ArchiveName(FormatMarkdown, nil), "markdown"},
+		{c.ArchiveName(FormatJSON, nil) + ".age", "json"},
+		{c.ArchiveName(FormatHTML, engineering), "html-eng8h2KdLq"},
+		{c.ArchiveName(FormatMarkdown, engineering) + ".gpg", "markdown-eng8h2KdLq"},
+		// The same collection before it was renamed
+		{"wiki.example.com-outline-backup-markdown-engineering-eng8h2KdLq-2025-03-15T12:00:00Z.zip", "markdown-eng8h2KdLq"},
+		{c.ArchiveName(FormatJSON, &types.Collection{Name: "2024-Q1", URLID: "q1x9Zt4LmN"}), "json-q1x9Zt4LmN"},
+		{c.ArchiveName(FormatJSON, &types.Collection{Name: "!!!", URLID: "bng5Rt2KpQ"}), "json-bng5Rt2KpQ"},
+		{"wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00+01:00.zip", "markdown"},
+		// Named before the format was part of the name
+		{"wiki.example.com-outline-backup-2025-03-15T12:00:00Z.zip", ""},
+	}
+	for _, tt := range tests {
+		got, ok := ArchiveSeries(tt.name)
+		if !ok || got != tt.want {
+			t.Errorf("ArchiveSeries(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+		if _, ok := ArchiveTime(tt.name); !ok {
+			t.Errorf("ArchiveTime(%q) failed", tt.name)
+		}
+	}
+
+	for _, name := range []string{
+		"wiki.example.com-outline-backup-markdown-latest.zip",
+		"wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip.part",
+		"notes.zip",
+	} {
+		if got, ok := ArchiveSeries(name); ok {
+			t.Errorf("ArchiveSeries(%q) = %q, want no match", name, got)
+		}
+	}
+}
+
+func TestArchivePattern(t *testing.T) {
+	c, err := NewClient(Options{BaseURL: "https://wiki.example.com", Token: "test-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := c.ArchivePattern()
+
+	for _, name := range []string{
+		c.ArchiveName(FormatMarkdown, nil),
+		c.ArchiveName(FormatJSON, &types.Collection{Name: "HR", URLID: "hr3Jk9PqWx"}) + ".gpg",
+		"wiki.example.com-outline-backup-2025-03-15T12:00:00Z.zip",
+		"wiki.example.com-outline-backup-2025-03-15T12:00:00+01:00.zip.age",
+	} {
+		if !pattern.MatchString(name) {
+			t.Errorf("%q doesn't match", name)
+		}
+	}
+	for _, name := range []string{
+		"other.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip",
+		"other.example.com-outline-backup-2025-03-15T12:00:00Z.zip",
+		"wiki.example.com-outline-backup-2025-03-15T12:00:00Z.zip.sha256",
+		"wiki.example.com-outline-backup-latest.zip",
+		"wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip.part",
+	} {
+		if pattern.MatchString(name) {
+			t.Errorf("%q matches", name)
+		}
+	}
+}
+
+func TestIsCollectionArchive(t *testing.T) {
+	c, err := NewClient(Options{BaseURL: "https://my-wiki.example.com", Token: "test-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := &types.Collection{Name: "Archive", URLID: "arc7Wy4RsC"}
+
+	for _, format := range []string{FormatMarkdown, FormatHTML, FormatJSON} {
+		if name := c.ArchiveName(format, nil); IsCollectionArchive(name) {
+			t.Errorf("IsCollectionArchive(%q) = true for a workspace archive", name)
+		}
+		if name := c.ArchiveName(format, collection) + ".age"; !IsCollectionArchive(name) {
+			t.Errorf("IsCollectionArchive(%q) = false for a collection archive", name)
+		}
+	}
+	if IsCollectionArchive("my-wiki-export.zip") {
+		t.Error("IsCollectionArchive is true for a foreign file")
+	}
+}
+
+// progressServer reports the states of an export in turn, repeating the
+// last one, and counts the status checks.
+func progressServer(t *testing.T, opts Options, states ...types.FileOperation) (*Client, *atomic.Int32) {
+	t.Helper()
+	var checks atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != progressEndpoint {
+			http.NotFound(w, r)
+			return
+		}
+		n := int(checks.Add(1))
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "data": states[min(n, len(states))-1]})
+	}))
+	t.Cleanup(server.Close)
+
+	opts.BaseURL, opts.Token, opts.Logger = server.URL, "test-token", log.New(io.Discard, "", 0)
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &checks
+}
+
+func TestWaitForExportCompletion(t *testing.T) {
+	inProgress := types.FileOperation{State: "creating"}
+	tests := []struct {
+		name   string
+		states []types.FileOperation
+		want   string
+	}{
+		{"complete", []types.FileOperation{inProgress, inProgress, {State: StateComplete}}, ""},
+		{"error", []types.FileOperation{inProgress, {State: StateError, Error: "Collection too large"}}, `ended in state "error": Collection too large`},
+		{"expired", []types.FileOperation{{State: StateExpired}}, `ended in state "expired": no error message provided`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, checks := progressServer(t, Options{PollInterval: time.Millisecond, MaxPollInterval: time.Millisecond, ExportTimeout: time.Minute}, tt.states...)
+			err := c.WaitForExportCompletion(context.Background(), "op-1")
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+			if got := int(checks.Load()); got != len(tt.states) {
+				t.Errorf("checked %d times, want %d", got, len(tt.states))
+			}
+		})
+	}
+}
+
+func TestWaitForExportCompletionTimesOut(t *testing.T) {
+	c, _ := progressServer(t, Options{PollInterval: 10 * time.Millisecond, MaxPollInterval: time.Hour, ExportTimeout: 100 * time.Millisecond}, types.FileOperation{State: "creating"})
+	start := time.Now()
+	err := c.WaitForExportCompletion(context.Background(), "op-1")
+	if err == nil || !strings.Contains(err.Error(), `did not complete within 100ms (last state "creating")`) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	// The last wait is cut short at the deadline instead of doubling
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestWaitForExportCompletionCapsInterval(t *testing.T) {
+	c, checks := progressServer(t, Options{PollInterval: 5 * time.Millisecond, MaxPollInterval: 10 * time.Millisecond, ExportTimeout: 400 * time.Millisecond}, types.FileOperation{State: "creating"})
+	if err := c.WaitForExportCompletion(context.Background(), "op-1"); err == nil {
+		t.Fatal("WaitForExportCompletion succeeded")
+	}
+	// Doubling without the cap would leave time for about 7 checks
+	if got := checks.Load(); got < 20 {
+		t.Errorf("checked %d times in 400ms, want the interval capped at 10ms", got)
+	}
+}
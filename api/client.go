@@ -0,0 +1,350 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+const (
+	defaultUserAgent       = "outlinewikibackup"
+	redacted               = "********"
+	defaultPollInterval    = 10 * time.Second
+	defaultMaxPollInterval = 60 * time.Second
+	defaultExportTimeout   = 30 * time.Minute
+)
+
+const (
+	defaultRetryAttempts = 4
+	defaultRetryBackoff  = 2 * time.Second
+	maxRetryDelay        = 2 * time.Minute
+)
+
+// Options configures a Client. Only BaseURL and Token are required; zero
+// values of the other fields select the defaults.
+type Options struct {
+	// BaseURL is the root URL of the Outline instance, without /api.
+	BaseURL string
+	// Token is an Outline API key.
+	Token string
+	// HTTPClient is used for all requests. Defaults to a client with a
+	// 30 second timeout.
+	HTTPClient *http.Client
+	// UserAgent is sent with every request.
+	UserAgent string
+	// Logger receives progress and error messages. Defaults to log.Default().
+	Logger *log.Logger
+
+	// RetryAttempts is the number of attempts for each API request.
+	RetryAttempts int
+	// PollInterval is the initial wait between export status checks. It
+	// doubles after every check up to MaxPollInterval.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// ExportTimeout bounds how long WaitForExportCompletion waits.
+	ExportTimeout time.Duration
+}
+
+// Client talks to the Outline API on behalf of a single API key.
+type Client struct {
+	baseURL *url.URL
+	opts    Options
+	http    *http.Client
+	logger  *log.Logger
+
+	// download shares the transport of http but has no overall timeout,
+	// since archives can take far longer than an API call to transfer.
+	download *http.Client
+}
+
+// NewClient validates opts and returns a Client. It does not contact the
+// server.
+func NewClient(opts Options) (*Client, error) {
+	if opts.BaseURL == "" {
+		return nil, errors.New("base URL is not set")
+	}
+	if opts.Token == "" {
+		return nil, errors.New("API token is not set")
+	}
+
+	baseURL, err := url.ParseRequestURI(opts.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("base URL is not a valid URL: %w", err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("base URL %q must use http or https", opts.BaseURL)
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/")
+
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaultUserAgent
+	}
+	if opts.RetryAttempts <= 0 {
+		opts.RetryAttempts = defaultRetryAttempts
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.MaxPollInterval < opts.PollInterval {
+		opts.MaxPollInterval = max(defaultMaxPollInterval, opts.PollInterval)
+	}
+	if opts.ExportTimeout <= 0 {
+		opts.ExportTimeout = defaultExportTimeout
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		// Use a more robust HTTP client with better timeout handling
+		httpClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   10,
+				IdleConnTimeout:       90 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		}
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	downloadClient := *httpClient
+	downloadClient.Timeout = 0
+
+	return &Client{
+		baseURL:  baseURL,
+		opts:     opts,
+		http:     httpClient,
+		logger:   logger,
+		download: &downloadClient,
+	}, nil
+}
+
+// Hostname returns the host name of the Outline instance, used to name
+// archives.
+func (c *Client) Hostname() string {
+	return c.baseURL.Hostname()
+}
+
+// APIError is returned for non-2xx responses from the Outline API and
+// carries the error code and message from the response body.
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s returned HTTP %d", e.Endpoint, e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *APIError) Temporary() bool {
+	return retryableStatus(e.StatusCode)
+}
+
+func (c *Client) makeAPIRequest(ctx context.Context, endpoint string, payload map[string]any) (*http.Response, error) {
+	return c.doAPIRequest(ctx, c.http, endpoint, payload)
+}
+
+func (c *Client) doAPIRequest(ctx context.Context, client *http.Client, endpoint string, payload map[string]any) (resp *http.Response, err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		c.logger.Println("Error marshalling payload:", err)
+		return nil, err
+	}
+
+	attempts := c.opts.RetryAttempts
+	backoff := defaultRetryBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL.String()+endpoint, bytes.NewReader(body))
+		if err != nil {
+			c.logger.Println("Error creating request:", err)
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", c.opts.UserAgent)
+
+		var delay time.Duration
+		resp, err = client.Do(req)
+		if err == nil {
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return resp, nil
+			}
+			delay = retryAfter(resp.Header)
+			err = newAPIError(endpoint, resp, c.opts.Token)
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			c.logger.Println("Request failed:", err)
+			return nil, err
+		}
+		// Starting an export isn't idempotent: after a 5xx or a broken
+		// connection Outline may already have created it, and a retry
+		// would leave that export behind
+		rateLimited := apiErr != nil && apiErr.StatusCode == http.StatusTooManyRequests
+		if startsExport(endpoint) && !rateLimited && !unsent(err) {
+			c.logger.Printf("Request to %s failed: %v; not retrying, since the export may have been started", endpoint, err)
+			return nil, err
+		}
+		if attempt >= attempts {
+			c.logger.Printf("Request to %s failed after %d attempts: %v", endpoint, attempt, err)
+			return nil, err
+		}
+
+		if delay == 0 {
+			delay = jitter(backoff)
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		c.logger.Printf("Request to %s failed (attempt %d/%d): %v; retrying in %s", endpoint, attempt, attempts, err, delay.Round(time.Millisecond))
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+
+		backoff *= 2
+	}
+}
+
+func startsExport(endpoint string) bool {
+	return endpoint == exportEndpoint || endpoint == collectionExportEndpoint
+}
+
+// unsent reports whether err means the request never reached the server.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// newAPIError reads the error from resp. Proxies and misconfigured servers
+// sometimes echo the request, so the token is removed from the message.
+func newAPIError(endpoint string, resp *http.Response, token string) *APIError {
+	defer resp.Body.Close()
+
+	apiErr := &APIError{Endpoint: endpoint, StatusCode: resp.StatusCode}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errResp types.ErrorResponse
+	if err := json.Unmarshal(data, &errResp); err == nil {
+		apiErr.Code = errResp.Error
+		apiErr.Message = errResp.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	apiErr.Code = strings.ReplaceAll(apiErr.Code, token, redacted)
+	apiErr.Message = strings.ReplaceAll(apiErr.Message, token, redacted)
+
+	return apiErr
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns how long the server asked us to wait, based on the
+// Retry-After header or Outline's RateLimit-Reset header. It returns zero
+// when neither header is usable.
+func retryAfter(header http.Header) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if t, err := http.ParseTime(value); err == nil {
+			return max(time.Until(t), 0)
+		}
+	}
+
+	for _, key := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		value := header.Get(key)
+		if value == "" {
+			continue
+		}
+		if t, ok := parseResetTime(value); ok {
+			return max(time.Until(t), 0)
+		}
+	}
+
+	return 0
+}
+
+// parseResetTime understands the reset formats seen in the wild: a unix
+// timestamp, an HTTP date or the JavaScript Date string Outline sends.
+func parseResetTime(value string) (time.Time, bool) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(n, 0), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	if i := strings.Index(value, " ("); i > 0 {
+		value = value[:i]
+	}
+	if t, err := time.Parse("Mon Jan 02 2006 15:04:05 GMT-0700", value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// jitter returns a random duration in [d/2, d) so that concurrent runs
+// don't poll the server in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + rand.N(half)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	unix := strconv.FormatInt(now.Add(30*time.Second).Unix(), 10)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{"fraction", http.Header{"Retry-After": {"0.5"}}, 500 * time.Millisecond},
+		{"date", http.Header{"Retry-After": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}}, time.Minute},
+		{"past date", http.Header{"Retry-After": {now.Add(-time.Minute).UTC().Format(http.TimeFormat)}}, 0},
+		{"unix reset", http.Header{"Ratelimit-Reset": {unix}}, 30 * time.Second},
+		{"x reset", http.Header{"X-Ratelimit-Reset": {unix}}, 30 * time.Second},
+		{"outline reset", http.Header{"Ratelimit-Reset": {now.Add(time.Minute).UTC().Format("Mon Jan 02 2006 15:04:05 GMT-0700") + " (Coordinated Universal Time)"}}, time.Minute},
+		{"retry after first", http.Header{"Retry-After": {"7"}, "Ratelimit-Reset": {unix}}, 7 * time.Second},
+		{"invalid", http.Header{"Retry-After": {"soon"}, "Ratelimit-Reset": {"later"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := retryAfter(tt.header)
+			// Dates only have a resolution of seconds
+			if got < tt.want-2*time.Second || got > tt.want || (tt.want == 0 && got != 0) {
+				t.Errorf("retryAfter = %s, want about %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingServer answers every request with status, asking for a retry
+// right away.
+func countingServer(t *testing.T, status int) (*Client, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "0.01")
+		http.Error(w, `{"ok":false}`, status)
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := NewClient(Options{BaseURL: server.URL, Token: "test-token", RetryAttempts: 3, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &requests
+}
+
+func TestExportStartRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		endpoint string
+		want     int32
+	}{
+		{"export after server error", http.StatusBadGateway, exportEndpoint, 1},
+		{"collection export after server error", http.StatusServiceUnavailable, collectionExportEndpoint, 1},
+		{"export when rate limited", http.StatusTooManyRequests, exportEndpoint, 3},
+		{"other request after server error", http.StatusBadGateway, progressEndpoint, 3},
+		{"client error", http.StatusBadRequest, progressEndpoint, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, requests := countingServer(t, tt.status)
+			if _, err := c.makeAPIRequest(context.Background(), tt.endpoint, map[string]any{"format": FormatJSON}); err == nil {
+				t.Fatal("request succeeded")
+			}
+			if got := requests.Load(); got != tt.want {
+				t.Errorf("sent %d requests, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnsent(t *testing.T) {
+	// Nothing listens on a closed listener's port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = http.Post("http://"+addr+exportEndpoint, "application/json", nil)
+	if err == nil || !unsent(err) {
+		t.Errorf("unsent(%v) = false for a refused connection", err)
+	}
+
+	// The server received the request before the connection broke
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+	_, err = http.Post(server.URL+exportEndpoint, "application/json", nil)
+	if err == nil || unsent(err) {
+		t.Errorf("unsent(%v) = true for a request that reached the server", err)
+	}
+
+	if unsent(errors.New("other")) {
+		t.Error("unsent is true for an unrelated error")
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"strings"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+// ListCollections returns every collection the API key can read.
+func (c *Client) ListCollections(ctx context.Context) ([]types.Collection, error) {
+	return listAll[types.Collection](ctx, c, collectionsListEndpoint, nil)
+}
+
+// FilterCollections keeps the collections matching include (all of them when
+// include is empty) and drops those matching exclude. Entries match a
+// collection's ID, URL ID or name, ignoring case.
+func FilterCollections(collections []types.Collection, include, exclude []string) []types.Collection {
+	var filtered []types.Collection
+	for _, collection := range collections {
+		if len(include) > 0 && !matchesCollection(collection, include) {
+			continue
+		}
+		if matchesCollection(collection, exclude) {
+			continue
+		}
+		filtered = append(filtered, collection)
+	}
+	return filtered
+}
+
+func matchesCollection(collection types.Collection, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, collection.ID) ||
+			strings.EqualFold(pattern, collection.URLID) ||
+			strings.EqualFold(pattern, collection.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Slugify lowercases name and replaces every run of characters other than
+// letters and digits with a single dash.
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "collection"
+	}
+	return slug
+}
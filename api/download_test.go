@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		start, size int64
+		ok          bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-0/1", 0, 1, true},
+		{"bytes 100-199/*", 100, -1, true},
+		{"bytes */200", 0, 0, false},
+		{"bytes 100-199", 0, 0, false},
+		{"bytes x-199/200", 0, 0, false},
+		{"bytes 100-199/y", 0, 0, false},
+		{"items 100-199/200", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, size, ok := parseContentRange(tt.in)
+		if ok != tt.ok || (ok && (start != tt.start || size != tt.size)) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v; want %d, %d, %v", tt.in, start, size, ok, tt.start, tt.size, tt.ok)
+		}
+	}
+}
+
+// expiringStorage redirects every download request to a signed URL that is
+// only valid until the next one is issued, and cuts the first transfer
+// short.
+type expiringStorage struct {
+	archive []byte
+
+	mu        sync.Mutex
+	redirects int
+	ranges    []string
+}
+
+func (s *expiringStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Path {
+	case downloadEndpoint:
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.redirects++
+		http.Redirect(w, r, fmt.Sprintf("/storage?signature=%d", s.redirects), http.StatusFound)
+
+	case "/storage":
+		if r.URL.Query().Get("signature") != strconv.Itoa(s.redirects) {
+			http.Error(w, "expired", http.StatusForbidden)
+			return
+		}
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		if s.redirects == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.archive)))
+			w.Write(s.archive[:len(s.archive)/3])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "export.zip", time.Time{}, bytes.NewReader(s.archive))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExportReaderResumes(t *testing.T) {
+	storage := &expiringStorage{archive: bytes.Repeat([]byte("0123456789abcdef"), 4096)}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	c, err := NewClient(Options{BaseURL: server.URL, Token: "test-token", Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.OpenExport(context.Background(), "export-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, storage.archive) {
+		t.Fatalf("read %d bytes that differ from the %d byte archive", len(got), len(storage.archive))
+	}
+	if storage.redirects != 2 {
+		t.Errorf("asked Outline for the archive %d times, want 2", storage.redirects)
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(storage.archive)/3); len(storage.ranges) != 2 || storage.ranges[1] != want {
+		t.Errorf("storage saw Range headers %q, want the second to be %q", storage.ranges, want)
+	}
+	if r.Offset() != int64(len(storage.archive)) {
+		t.Errorf("Offset() = %d, want %d", r.Offset(), len(storage.archive))
+	}
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"context"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+const fileOperationTypeExport = "export"
+
+// ListExports returns the export file operations visible to the API key,
+// newest first.
+func (c *Client) ListExports(ctx context.Context) ([]types.FileOperation, error) {
+	params := map[string]any{
+		"type": fileOperationTypeExport,
+	}
+	return listAll[types.FileOperation](ctx, c, fileOperationsListEndpoint, params)
+}
+
+// CurrentUserID returns the ID of the user that owns the API key.
+func (c *Client) CurrentUserID(ctx context.Context) (string, error) {
+	var info types.AuthInfoResponse
+	if err := c.postJSON(ctx, authInfoEndpoint, map[string]any{}, &info); err != nil {
+		return "", err
+	}
+	return info.Data.User.ID, nil
+}
@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+// ErrNoDocuments is returned, wrapped and with a complete summary, for an
+// archive that is intact but holds no documents.
+var ErrNoDocuments = errors.New("no documents")
+
+// Verify opens the zip archive at filename, reads every entry so that its
+// CRC-32 is checked, and counts the documents and attachments it contains.
+// An archive without any documents is treated as an error, ErrNoDocuments.
+func Verify(ctx context.Context, filename string) (types.ArchiveSummary, error) {
+	summary := types.ArchiveSummary{Path: filename}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return summary, fmt.Errorf("unable to stat archive %q: %w", filename, err)
+	}
+	summary.Size = info.Size()
+
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return summary, fmt.Errorf("unable to open archive %q: %w", filename, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		documents, err := verifyEntry(f)
+		if err != nil {
+			return summary, fmt.Errorf("archive %q is corrupt: entry %q: %w", filename, f.Name, err)
+		}
+
+		summary.Entries++
+		if documents > 0 {
+			summary.Documents += documents
+		} else if isAttachment(f.Name) {
+			summary.Attachments++
+		}
+	}
+
+	if summary.Documents == 0 {
+		return summary, fmt.Errorf("archive %q contains %w", filename, ErrNoDocuments)
+	}
+
+	return summary, nil
+}
+
+// verifyEntry reads f to the end, which makes archive/zip check its CRC, and
+// returns the number of documents it holds.
+func verifyEntry(f *zip.File) (int, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	return countDocuments(f.Name, rc)
+}
+
+// countDocuments reads the entry named name from r to the end and returns the
+// number of documents it holds.
+func countDocuments(name string, r io.Reader) (int, error) {
+	documents := 0
+	switch ext := strings.ToLower(path.Ext(name)); {
+	case isAttachment(name):
+	case ext == ".md" || ext == ".html":
+		documents = 1
+	case ext == ".json" && path.Base(name) != "metadata.json":
+		// JSON exports hold one file per collection with its documents
+		// keyed by ID.
+		var collection struct {
+			Documents map[string]json.RawMessage `json:"documents"`
+		}
+		if err := json.NewDecoder(r).Decode(&collection); errors.Is(err, zip.ErrChecksum) {
+			return 0, err
+		}
+		documents = len(collection.Documents)
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return 0, err
+	}
+	return documents, nil
+}
+
+// isAttachment reports whether name lies in an uploads folder, which is
+// where Outline puts images and other attachments in every export format.
+func isAttachment(name string) bool {
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		if dir == "uploads" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package archive
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/stenstromen/outlinewikibackup/types"
+)
+
+const (
+	localHeaderSignature    = 0x04034b50
+	centralHeaderSignature  = 0x02014b50
+	endOfDirectorySignature = 0x06054b50
+	dataDescriptorSignature = 0x08074b50
+
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+	zip64ExtraID       = 0x0001
+)
+
+// localHeader is the fixed part of a zip local file header, after its
+// signature.
+type localHeader struct {
+	Version        uint16
+	Flags          uint16
+	Method         uint16
+	ModTime        uint16
+	ModDate        uint16
+	CRC32          uint32
+	CompressedSize uint32
+	Size           uint32
+	NameLength     uint16
+	ExtraLength    uint16
+}
+
+// VerifyStream is Verify for an archive that can only be read once from
+// start to end, such as one that is being encrypted on its way to storage.
+// It walks the local file headers instead of the central directory, checks
+// the CRC-32 of every entry and reads r to the end. name is only used in
+// messages and the summary.
+func VerifyStream(ctx context.Context, r io.Reader, name string) (types.ArchiveSummary, error) {
+	summary := types.ArchiveSummary{Path: name}
+	counter := &countingReader{r: r}
+	br := bufio.NewReader(counter)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+
+		var signature uint32
+		if err := binary.Read(br, binary.LittleEndian, &signature); err != nil {
+			return summary, fmt.Errorf("archive %q is corrupt: %w", name, noEOF(err))
+		}
+		if signature == centralHeaderSignature || signature == endOfDirectorySignature {
+			break
+		}
+		if signature != localHeaderSignature {
+			return summary, fmt.Errorf("archive %q is corrupt: unexpected signature %#08x", name, signature)
+		}
+
+		entry, documents, err := readEntry(br)
+		if err != nil {
+			return summary, fmt.Errorf("archive %q is corrupt: entry %q: %w", name, entry, err)
+		}
+		if strings.HasSuffix(entry, "/") {
+			continue
+		}
+
+		summary.Entries++
+		if documents > 0 {
+			summary.Documents += documents
+		} else if isAttachment(entry) {
+			summary.Attachments++
+		}
+	}
+
+	// The central directory only repeats what has been read
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return summary, fmt.Errorf("unable to read archive %q: %w", name, err)
+	}
+	summary.Size = counter.n
+
+	if summary.Documents == 0 {
+		return summary, fmt.Errorf("archive %q contains %w", name, ErrNoDocuments)
+	}
+
+	return summary, nil
+}
+
+// readEntry reads the entry whose local header follows in br, including its
+// data descriptor, and returns its name and the number of documents it
+// holds.
+func readEntry(br *bufio.Reader) (string, int, error) {
+	var h localHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return "", 0, noEOF(err)
+	}
+	nameAndExtra := make([]byte, int(h.NameLength)+int(h.ExtraLength))
+	if _, err := io.ReadFull(br, nameAndExtra); err != nil {
+		return "", 0, noEOF(err)
+	}
+	name := string(nameAndExtra[:h.NameLength])
+	compressedSize, zip64 := zip64Size(nameAndExtra[h.NameLength:], h.CompressedSize, h.Size)
+
+	if h.Flags&flagEncrypted != 0 {
+		return name, 0, errors.New("encrypted entries are not supported")
+	}
+
+	// Streamed entries carry their sizes after the data. Deflate data ends
+	// by itself, and flate doesn't read past it from an io.ByteReader.
+	descriptor := h.Flags&flagDataDescriptor != 0
+	var data io.Reader = io.LimitReader(br, int64(compressedSize))
+	if descriptor {
+		switch {
+		case h.Method == zip.Deflate:
+			data = br
+		case strings.HasSuffix(name, "/"):
+			data = strings.NewReader("")
+		default:
+			return name, 0, errors.New("stored entries of unknown size are not supported")
+		}
+	}
+
+	var content io.Reader
+	switch h.Method {
+	case zip.Store:
+		content = data
+	case zip.Deflate:
+		fr := flate.NewReader(data)
+		defer fr.Close()
+		content = fr
+	default:
+		return name, 0, zip.ErrAlgorithm
+	}
+
+	crc := crc32.NewIEEE()
+	documents, err := countDocuments(name, io.TeeReader(content, crc))
+	if err != nil {
+		return name, 0, noEOF(err)
+	}
+	if !descriptor {
+		// Skip anything the decompressor left unread
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return name, 0, noEOF(err)
+		}
+	}
+
+	want := h.CRC32
+	if descriptor {
+		if want, err = readDataDescriptor(br, zip64); err != nil {
+			return name, 0, noEOF(err)
+		}
+	}
+	if crc.Sum32() != want {
+		return name, 0, zip.ErrChecksum
+	}
+	return name, documents, nil
+}
+
+// zip64Size returns the compressed size of an entry, taking it from the
+// Zip64 extra field when the header doesn't have room for it, and whether
+// there was such a field.
+func zip64Size(extra []byte, compressedSize, size uint32) (uint64, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if n > len(extra) {
+			break
+		}
+		if id == zip64ExtraID {
+			field := extra[:n]
+			if size == ^uint32(0) && len(field) >= 8 {
+				field = field[8:]
+			}
+			if compressedSize == ^uint32(0) && len(field) >= 8 {
+				return binary.LittleEndian.Uint64(field), true
+			}
+			return uint64(compressedSize), true
+		}
+		extra = extra[n:]
+	}
+	return uint64(compressedSize), false
+}
+
+// readDataDescriptor reads the descriptor that follows the data of a
+// streamed entry and returns its CRC-32.
+func readDataDescriptor(br *bufio.Reader, zip64 bool) (uint32, error) {
+	// The signature is optional
+	if b, err := br.Peek(4); err == nil && binary.LittleEndian.Uint32(b) == dataDescriptorSignature {
+		br.Discard(4)
+	}
+
+	var crc uint32
+	if err := binary.Read(br, binary.LittleEndian, &crc); err != nil {
+		return 0, err
+	}
+	sizes := 8
+	if zip64 {
+		sizes = 16
+	} else if b, err := br.Peek(12); err == nil && !isSignature(binary.LittleEndian.Uint32(b[8:])) {
+		// Writers such as archive/zip switch to 64-bit sizes for large
+		// entries without a Zip64 extra field in the local header
+		sizes = 16
+	}
+	if _, err := br.Discard(sizes); err != nil {
+		return 0, err
+	}
+	return crc, nil
+}
+
+func isSignature(v uint32) bool {
+	return v == localHeaderSignature || v == centralHeaderSignature || v == endOfDirectorySignature
+}
+
+// noEOF turns the io.EOF of an archive that ends too early into
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
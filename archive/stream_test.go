@@ -0,0 +1,150 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	name string
+	data string
+	// stored entries are written uncompressed with their sizes in the
+	// local header, the others deflated with a data descriptor
+	stored bool
+}
+
+func buildZip(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		if e.stored {
+			w, err := zw.CreateRaw(&zip.FileHeader{
+				Name:               e.name,
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE([]byte(e.data)),
+				CompressedSize64:   uint64(len(e.data)),
+				UncompressedSize64: uint64(len(e.data)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(e.data)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var export = []entry{
+	{name: "Engineering/"},
+	{name: "Engineering/Welcome.md", data: "# Welcome\n"},
+	{name: "Engineering/Handbook.md", data: "# Handbook\n" + string(bytes.Repeat([]byte("text "), 10000))},
+	{name: "Engineering/Notes.html", data: "<h1>Notes</h1>", stored: true},
+	{name: "Engineering.json", data: `{"collection": {}, "documents": {"a": {}, "b": {}}}`},
+	{name: "metadata.json", data: `{"documents": {"ignored": {}}}`},
+	{name: "uploads/eng/logo.png", data: "\x89PNG\r\n\x1a\n", stored: true},
+	{name: "uploads/eng/diagram.md", data: "# not a document"},
+}
+
+func TestVerifyStream(t *testing.T) {
+	data := buildZip(t, export)
+	summary, err := VerifyStream(context.Background(), bytes.NewReader(data), "test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Documents != 5 || summary.Attachments != 2 || summary.Entries != 7 || summary.Size != int64(len(data)) {
+		t.Errorf("got %+v, want 5 documents, 2 attachments, 7 entries and %d bytes", summary, len(data))
+	}
+
+	// The central directory gives the same result
+	path := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Verify(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Path = summary.Path
+	if summary != want {
+		t.Errorf("VerifyStream = %+v, Verify = %+v", summary, want)
+	}
+}
+
+func TestVerifyStreamCorrupt(t *testing.T) {
+	data := buildZip(t, export)
+
+	for _, tt := range []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"truncated", func(b []byte) []byte { return b[:len(b)/2] }},
+		{"flipped", func(b []byte) []byte {
+			// Inside the stored HTML entry
+			i := bytes.Index(b, []byte("<h1>Notes"))
+			b[i+4] ^= 0xff
+			return b
+		}},
+		{"not a zip", func([]byte) []byte { return []byte("<html>Service Unavailable</html>") }},
+		{"empty", func([]byte) []byte { return nil }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mangled := tt.mangle(bytes.Clone(data))
+			if _, err := VerifyStream(context.Background(), bytes.NewReader(mangled), "test.zip"); err == nil {
+				t.Error("VerifyStream succeeded")
+			}
+		})
+	}
+}
+
+func TestVerifyStreamNoDocuments(t *testing.T) {
+	data := buildZip(t, []entry{
+		{name: "metadata.json", data: `{}`},
+		{name: "uploads/logo.png", data: "png"},
+	})
+	summary, err := VerifyStream(context.Background(), bytes.NewReader(data), "test.zip")
+	if !errors.Is(err, ErrNoDocuments) {
+		t.Fatalf("got %v, want ErrNoDocuments", err)
+	}
+	if summary.Entries != 2 || summary.Attachments != 1 || summary.Size != int64(len(data)) {
+		t.Errorf("got %+v, want a complete summary", summary)
+	}
+}
+
+func TestVerifyStreamCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := buildZip(t, export)
+	if _, err := VerifyStream(ctx, bytes.NewReader(data), "test.zip"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestVerifyNoDocuments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(path, buildZip(t, []entry{{name: "Archive/"}}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(context.Background(), path); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("got %v, want ErrNoDocuments", err)
+	}
+}
@@ -0,0 +1,286 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stenstromen/outlinewikibackup/api"
+	"github.com/stenstromen/outlinewikibackup/file"
+	"github.com/stenstromen/outlinewikibackup/notify"
+	"github.com/stenstromen/outlinewikibackup/retention"
+	"github.com/stenstromen/outlinewikibackup/s3api"
+	"github.com/stenstromen/outlinewikibackup/schedule"
+	"github.com/stenstromen/outlinewikibackup/secrets"
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+// binding ties a setting of the file to its environment variable.
+type binding struct {
+	path     string
+	env      string
+	secret   bool
+	required bool
+	get      func() string
+	set      func(string) error
+	// check returns the value in the form the tool expects, or why it is
+	// invalid.
+	check func(string) (string, error)
+}
+
+func (c *Config) bindings() []binding {
+	s := &c.Source
+	bindings := []binding{
+		required(value("source.url", "API_BASE_URL", &s.URL, checkURL)),
+		required(value("source.token", "AUTH_TOKEN", &s.Token, nil)),
+		value("source.token_file", "AUTH_TOKEN_FILE", &s.TokenFile, nil),
+		list("source.formats", "EXPORT_FORMAT", &s.Formats, checkFormats),
+		value("source.mode", "EXPORT_MODE", &s.Mode, oneOf("all", "collections")),
+		list("source.collections.include", "COLLECTIONS_INCLUDE", &s.Collections.Include, nil),
+		list("source.collections.exclude", "COLLECTIONS_EXCLUDE", &s.Collections.Exclude, nil),
+		value("source.retry_attempts", "API_RETRY_ATTEMPTS", &s.RetryAttempts, checkCount(1)),
+		value("source.poll_interval", "SLEEP_DURATION", &s.PollInterval, checkCount(1)),
+		value("source.max_poll_interval", "MAX_SLEEP_DURATION", &s.MaxPollInterval, checkCount(1)),
+		value("source.export_timeout", "EXPORT_TIMEOUT", &s.ExportTimeout, checkCount(1)),
+		value("source.reuse_export_max_age", "REUSE_EXPORT_MAX_AGE", &s.ReuseExportMaxAge, checkDuration),
+		value("source.stale_export_max_age", "STALE_EXPORT_MAX_AGE", &s.StaleExportMaxAge, checkDuration),
+
+		value("save_dir", "SAVE_DIR", &c.SaveDir, nil),
+		value("stream", "STREAM_TO_S3", &c.Stream, checkBool),
+		value("upload.part_size_mib", "S3_PART_SIZE", &c.Upload.PartSizeMiB, checkCount(5)),
+		value("upload.concurrency", "S3_UPLOAD_CONCURRENCY", &c.Upload.Concurrency, checkCount(1)),
+
+		list("encryption.age_recipients", "ENCRYPTION_AGE_RECIPIENTS", &c.Encryption.AgeRecipients, nil),
+		value("encryption.age_recipients_file", "ENCRYPTION_AGE_RECIPIENTS_FILE", &c.Encryption.AgeRecipientsFile, nil),
+		value("encryption.pgp_public_key_file", "ENCRYPTION_PGP_PUBLIC_KEY_FILE", &c.Encryption.PGPPublicKeyFile, nil),
+		value("encryption.age_identity_file", "ENCRYPTION_AGE_IDENTITY_FILE", &c.Encryption.AgeIdentityFile, nil),
+		value("encryption.pgp_private_key_file", "ENCRYPTION_PGP_PRIVATE_KEY_FILE", &c.Encryption.PGPPrivateKeyFile, nil),
+		value("encryption.pgp_passphrase", "ENCRYPTION_PGP_PASSPHRASE", &c.Encryption.PGPPassphrase, nil),
+		value("encryption.pgp_passphrase_file", "ENCRYPTION_PGP_PASSPHRASE_FILE", &c.Encryption.PGPPassphraseFile, nil),
+
+		value("notifications.webhook.url", "NOTIFY_WEBHOOK_URL", &c.Notifications.Webhook.URL, checkURL),
+		value("notifications.webhook.url_file", "NOTIFY_WEBHOOK_URL_FILE", &c.Notifications.Webhook.URLFile, nil),
+		value("notifications.webhook.on", "NOTIFY_ON", &c.Notifications.Webhook.On, oneOf(notify.OnFailure, notify.OnAlways)),
+		value("schedule", "SCHEDULE", &c.Schedule, checkSchedule),
+	}
+	bindings = append(bindings, retentionBindings("retention", "", &c.Retention)...)
+
+	s3 := &c.S3
+	bindings = append(bindings,
+		value("s3.enabled", "UPLOAD_TO_S3", &s3.Enabled, checkBool),
+		value("s3.bucket", "S3_BUCKET_NAME", &s3.Bucket, nil),
+		value("s3.provider", "S3_PROVIDER", &s3.Provider, oneOf(s3api.Providers()...)),
+		value("s3.endpoint", "S3_ENDPOINT", &s3.Endpoint, nil),
+		value("s3.minio_endpoint", "MINIO_ENDPOINT", &s3.MinIOEndpoint, nil),
+		value("s3.garage_endpoint", "GARAGE_ENDPOINT", &s3.GarageEndpoint, nil),
+		value("s3.region", "S3_REGION", &s3.Region, nil),
+		value("s3.signing_region", "S3_SIGNING_REGION", &s3.SigningRegion, nil),
+		value("s3.force_path_style", "S3_FORCE_PATH_STYLE", &s3.ForcePathStyle, checkBool),
+		value("s3.checksum_mode", "S3_CHECKSUM_MODE", &s3.ChecksumMode, oneOf(s3api.ChecksumWhenSupported, s3api.ChecksumWhenRequired)),
+		value("s3.insecure_skip_verify", "S3_INSECURE_SKIP_VERIFY", &s3.InsecureSkipVerify, checkBool),
+		value("s3.access_key_id", "S3_ACCESS_KEY_ID", &s3.AccessKeyID, nil),
+		value("s3.secret_access_key", "S3_SECRET_ACCESS_KEY", &s3.SecretAccessKey, nil),
+		value("s3.secret_access_key_file", "S3_SECRET_ACCESS_KEY_FILE", &s3.SecretAccessKeyFile, nil),
+		value("s3.minimal_permissions", "MINIMAL_S3_PERMISSIONS", &s3.MinimalPermissions, checkBool),
+		value("s3.sse.mode", "S3_SSE", &s3.SSE.Mode, oneOf(storage.SSES3, storage.SSEKMS, storage.SSEC)),
+		value("s3.sse.kms_key_id", "S3_SSE_KMS_KEY_ID", &s3.SSE.KMSKeyID, nil),
+		value("s3.sse.customer_key", "S3_SSE_CUSTOMER_KEY", &s3.SSE.CustomerKey, checkCustomerKey),
+		value("s3.sse.customer_key_file", "S3_SSE_CUSTOMER_KEY_FILE", &s3.SSE.CustomerKeyFile, nil),
+		value("s3.object_lock.mode", "S3_OBJECT_LOCK_MODE", &s3.ObjectLock.Mode, oneOf("governance", "compliance")),
+		value("s3.object_lock.period", "S3_OBJECT_LOCK_PERIOD", &s3.ObjectLock.Period, checkDuration),
+		value("s3.object_lock.legal_hold", "S3_OBJECT_LOCK_LEGAL_HOLD", &s3.ObjectLock.LegalHold, checkBool),
+		value("s3.storage_class", "S3_STORAGE_CLASS", &s3.StorageClass, checkStorageClass),
+		pairs("s3.tags", "S3_TAGS", &s3.Tags),
+		pairs("s3.metadata", "S3_METADATA", &s3.Metadata),
+
+		value("aws.region", "AWS_REGION", &c.AWS.Region, nil),
+		value("aws.access_key_id", "AWS_ACCESS_KEY_ID", &c.AWS.AccessKeyID, nil),
+		value("aws.secret_access_key", "AWS_SECRET_ACCESS_KEY", &c.AWS.SecretAccessKey, nil),
+		value("aws.secret_access_key_file", "AWS_SECRET_ACCESS_KEY_FILE", &c.AWS.SecretAccessKeyFile, nil),
+		value("aws.session_token", "AWS_SESSION_TOKEN", &c.AWS.SessionToken, nil),
+		value("aws.session_token_file", "AWS_SESSION_TOKEN_FILE", &c.AWS.SessionTokenFile, nil),
+	)
+
+	for _, name := range slices.Sorted(maps.Keys(c.Destinations)) {
+		d := c.Destinations[name]
+		if d == nil {
+			continue
+		}
+		path := "destinations." + name + "."
+		prefix := "DEST_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		bindings = append(bindings,
+			value(path+"type", prefix+"TYPE", &d.Type, oneOf("s3", "local")),
+			value(path+"dir", prefix+"DIR", &d.Dir, nil),
+			value(path+"bucket", prefix+"BUCKET", &d.Bucket, nil),
+			value(path+"prefix", prefix+"PREFIX", &d.Prefix, nil),
+			value(path+"provider", prefix+"PROVIDER", &d.Provider, oneOf(s3api.Providers()...)),
+			value(path+"endpoint", prefix+"ENDPOINT", &d.Endpoint, nil),
+			value(path+"region", prefix+"REGION", &d.Region, nil),
+			value(path+"signing_region", prefix+"SIGNING_REGION", &d.SigningRegion, nil),
+			value(path+"force_path_style", prefix+"FORCE_PATH_STYLE", &d.ForcePathStyle, checkBool),
+			value(path+"checksum_mode", prefix+"CHECKSUM_MODE", &d.ChecksumMode, oneOf(s3api.ChecksumWhenSupported, s3api.ChecksumWhenRequired)),
+			value(path+"insecure_skip_verify", prefix+"INSECURE_SKIP_VERIFY", &d.InsecureSkipVerify, checkBool),
+			value(path+"access_key_id", prefix+"ACCESS_KEY_ID", &d.AccessKeyID, nil),
+			value(path+"secret_access_key", prefix+"SECRET_ACCESS_KEY", &d.SecretAccessKey, nil),
+			value(path+"secret_access_key_file", prefix+"SECRET_ACCESS_KEY_FILE", &d.SecretAccessKeyFile, nil),
+			value(path+"minimal_permissions", prefix+"MINIMAL_PERMISSIONS", &d.MinimalPermissions, checkBool),
+			value(path+"sse.mode", prefix+"SSE", &d.SSE.Mode, oneOf(storage.SSES3, storage.SSEKMS, storage.SSEC)),
+			value(path+"sse.kms_key_id", prefix+"SSE_KMS_KEY_ID", &d.SSE.KMSKeyID, nil),
+			value(path+"sse.customer_key", prefix+"SSE_CUSTOMER_KEY", &d.SSE.CustomerKey, checkCustomerKey),
+			value(path+"sse.customer_key_file", prefix+"SSE_CUSTOMER_KEY_FILE", &d.SSE.CustomerKeyFile, nil),
+			value(path+"object_lock.mode", prefix+"OBJECT_LOCK_MODE", &d.ObjectLock.Mode, oneOf("governance", "compliance")),
+			value(path+"object_lock.period", prefix+"OBJECT_LOCK_PERIOD", &d.ObjectLock.Period, checkDuration),
+			value(path+"object_lock.legal_hold", prefix+"OBJECT_LOCK_LEGAL_HOLD", &d.ObjectLock.LegalHold, checkBool),
+			value(path+"storage_class", prefix+"STORAGE_CLASS", &d.StorageClass, checkStorageClass),
+			pairs(path+"tags", prefix+"TAGS", &d.Tags),
+			pairs(path+"metadata", prefix+"METADATA", &d.Metadata),
+		)
+		bindings = append(bindings, retentionBindings(path+"retention", prefix, &d.Retention)...)
+	}
+	return bindings
+}
+
+func retentionBindings(path, prefix string, r *Retention) []binding {
+	return []binding{
+		value(path+".last", prefix+"KEEP_BACKUPS", &r.Last, checkCount(1)),
+		value(path+".daily", prefix+"KEEP_DAILY", &r.Daily, checkCount(1)),
+		value(path+".weekly", prefix+"KEEP_WEEKLY", &r.Weekly, checkCount(1)),
+		value(path+".monthly", prefix+"KEEP_MONTHLY", &r.Monthly, checkCount(1)),
+		value(path+".yearly", prefix+"KEEP_YEARLY", &r.Yearly, checkCount(1)),
+		value(path+".min_age", prefix+"KEEP_MIN_AGE", &r.MinAge, checkDuration),
+		value(path+".max_size", prefix+"KEEP_MAX_SIZE", &r.MaxSize, checkSize),
+	}
+}
+
+func value(path, env string, v *Value, check func(string) (string, error)) binding {
+	return binding{
+		path:   path,
+		env:    env,
+		secret: secrets.IsSecret(env),
+		get:    func() string { return string(*v) },
+		set:    func(s string) error { *v = Value(s); return nil },
+		check:  check,
+	}
+}
+
+func list(path, env string, l *List, check func(string) (string, error)) binding {
+	return binding{
+		path:  path,
+		env:   env,
+		get:   func() string { return strings.Join(*l, ",") },
+		set:   func(s string) error { *l = splitList(s); return nil },
+		check: check,
+	}
+}
+
+func pairs(path, env string, p *Pairs) binding {
+	return binding{
+		path: path,
+		env:  env,
+		get: func() string {
+			var items []string
+			for _, k := range slices.Sorted(maps.Keys(*p)) {
+				items = append(items, k+"="+(*p)[k])
+			}
+			return strings.Join(items, ",")
+		},
+		set: func(s string) error {
+			parsed, err := file.ParsePairs(s)
+			*p = parsed
+			return err
+		},
+		check: func(s string) (string, error) {
+			_, err := file.ParsePairs(s)
+			return s, err
+		},
+	}
+}
+
+func required(b binding) binding {
+	b.required = true
+	return b
+}
+
+func oneOf(values ...string) func(string) (string, error) {
+	return func(s string) (string, error) {
+		lower := strings.ToLower(s)
+		if !slices.Contains(values, lower) {
+			return s, fmt.Errorf("%q is not one of %s", s, strings.Join(values, ", "))
+		}
+		return lower, nil
+	}
+}
+
+func checkCount(min int) func(string) (string, error) {
+	return func(s string) (string, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min {
+			return s, fmt.Errorf("%q is not a whole number of at least %d", s, min)
+		}
+		return s, nil
+	}
+}
+
+func checkBool(s string) (string, error) {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return s, fmt.Errorf("%q is not true or false", s)
+	}
+	return strconv.FormatBool(b), nil
+}
+
+func checkDuration(s string) (string, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return s, fmt.Errorf("%q is not a positive duration such as 72h", s)
+	}
+	return s, nil
+}
+
+func checkSize(s string) (string, error) {
+	size, err := retention.ParseSize(s)
+	if err != nil || size <= 0 {
+		return s, fmt.Errorf("%q is not a size such as 50GiB", s)
+	}
+	return s, nil
+}
+
+func checkURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return s, fmt.Errorf("not an http or https URL")
+	}
+	return s, nil
+}
+
+func checkFormats(s string) (string, error) {
+	_, err := api.ParseFormats(s)
+	return s, err
+}
+
+func checkSchedule(s string) (string, error) {
+	_, err := schedule.Parse(s)
+	return s, err
+}
+
+func checkCustomerKey(s string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return s, fmt.Errorf("not a base64 encoded 256-bit key")
+	}
+	return s, nil
+}
+
+func checkStorageClass(s string) (string, error) {
+	class := types.StorageClass(strings.ToUpper(s))
+	if !slices.Contains(class.Values(), class) {
+		return s, fmt.Errorf("%q is not an S3 storage class such as STANDARD_IA or GLACIER_IR", s)
+	}
+	return string(class), nil
+}
@@ -0,0 +1,503 @@
+// Package config reads the settings of a backup run from a YAML file, merges
+// them with the environment and validates them before anything runs.
+//
+// Every setting in the file has an environment variable, which takes
+// precedence over the file. Apply exports the merged settings to the
+// environment, where the rest of the tool reads them.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/stenstromen/outlinewikibackup/file"
+	"github.com/stenstromen/outlinewikibackup/secrets"
+	"github.com/stenstromen/outlinewikibackup/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of a configuration file.
+type Config struct {
+	Source        Source                  `yaml:"source"`
+	SaveDir       Value                   `yaml:"save_dir,omitempty"`
+	Stream        Value                   `yaml:"stream,omitempty"`
+	Upload        Upload                  `yaml:"upload,omitempty"`
+	Encryption    Encryption              `yaml:"encryption,omitempty"`
+	Retention     Retention               `yaml:"retention,omitempty"`
+	S3            S3                      `yaml:"s3,omitempty"`
+	AWS           AWS                     `yaml:"aws,omitempty"`
+	Destinations  map[string]*Destination `yaml:"destinations,omitempty"`
+	Notifications Notifications           `yaml:"notifications,omitempty"`
+	Schedule      Value                   `yaml:"schedule,omitempty"`
+}
+
+// Source is the Outline instance to back up and how to export it.
+type Source struct {
+	URL               Value       `yaml:"url,omitempty"`
+	Token             Value       `yaml:"token,omitempty"`
+	TokenFile         Value       `yaml:"token_file,omitempty"`
+	Formats           List        `yaml:"formats,omitempty"`
+	Mode              Value       `yaml:"mode,omitempty"`
+	Collections       Collections `yaml:"collections,omitempty"`
+	RetryAttempts     Value       `yaml:"retry_attempts,omitempty"`
+	PollInterval      Value       `yaml:"poll_interval,omitempty"`
+	MaxPollInterval   Value       `yaml:"max_poll_interval,omitempty"`
+	ExportTimeout     Value       `yaml:"export_timeout,omitempty"`
+	ReuseExportMaxAge Value       `yaml:"reuse_export_max_age,omitempty"`
+	StaleExportMaxAge Value       `yaml:"stale_export_max_age,omitempty"`
+}
+
+// Collections filters the collections exported in collections mode.
+type Collections struct {
+	Include List `yaml:"include,omitempty"`
+	Exclude List `yaml:"exclude,omitempty"`
+}
+
+// Upload controls S3 multipart uploads.
+type Upload struct {
+	PartSizeMiB Value `yaml:"part_size_mib,omitempty"`
+	Concurrency Value `yaml:"concurrency,omitempty"`
+}
+
+// Encryption holds the keys archives are encrypted with, and decrypted with
+// for restores.
+type Encryption struct {
+	AgeRecipients     List  `yaml:"age_recipients,omitempty"`
+	AgeRecipientsFile Value `yaml:"age_recipients_file,omitempty"`
+	PGPPublicKeyFile  Value `yaml:"pgp_public_key_file,omitempty"`
+	AgeIdentityFile   Value `yaml:"age_identity_file,omitempty"`
+	PGPPrivateKeyFile Value `yaml:"pgp_private_key_file,omitempty"`
+	PGPPassphrase     Value `yaml:"pgp_passphrase,omitempty"`
+	PGPPassphraseFile Value `yaml:"pgp_passphrase_file,omitempty"`
+}
+
+// Retention is a retention policy.
+type Retention struct {
+	Last    Value `yaml:"last,omitempty"`
+	Daily   Value `yaml:"daily,omitempty"`
+	Weekly  Value `yaml:"weekly,omitempty"`
+	Monthly Value `yaml:"monthly,omitempty"`
+	Yearly  Value `yaml:"yearly,omitempty"`
+	MinAge  Value `yaml:"min_age,omitempty"`
+	MaxSize Value `yaml:"max_size,omitempty"`
+}
+
+// Destination is a named place backups are stored in.
+type Destination struct {
+	Type                Value      `yaml:"type,omitempty"`
+	Dir                 Value      `yaml:"dir,omitempty"`
+	Bucket              Value      `yaml:"bucket,omitempty"`
+	Prefix              Value      `yaml:"prefix,omitempty"`
+	Provider            Value      `yaml:"provider,omitempty"`
+	Endpoint            Value      `yaml:"endpoint,omitempty"`
+	Region              Value      `yaml:"region,omitempty"`
+	SigningRegion       Value      `yaml:"signing_region,omitempty"`
+	ForcePathStyle      Value      `yaml:"force_path_style,omitempty"`
+	ChecksumMode        Value      `yaml:"checksum_mode,omitempty"`
+	InsecureSkipVerify  Value      `yaml:"insecure_skip_verify,omitempty"`
+	AccessKeyID         Value      `yaml:"access_key_id,omitempty"`
+	SecretAccessKey     Value      `yaml:"secret_access_key,omitempty"`
+	SecretAccessKeyFile Value      `yaml:"secret_access_key_file,omitempty"`
+	MinimalPermissions  Value      `yaml:"minimal_permissions,omitempty"`
+	SSE                 SSE        `yaml:"sse,omitempty"`
+	ObjectLock          ObjectLock `yaml:"object_lock,omitempty"`
+	StorageClass        Value      `yaml:"storage_class,omitempty"`
+	Tags                Pairs      `yaml:"tags,omitempty"`
+	Metadata            Pairs      `yaml:"metadata,omitempty"`
+	Retention           Retention  `yaml:"retention,omitempty"`
+}
+
+// S3 is the bucket archives are uploaded to when no destinations are set,
+// configured by UPLOAD_TO_S3 and the S3_* variables.
+type S3 struct {
+	Enabled             Value      `yaml:"enabled,omitempty"`
+	Bucket              Value      `yaml:"bucket,omitempty"`
+	Provider            Value      `yaml:"provider,omitempty"`
+	Endpoint            Value      `yaml:"endpoint,omitempty"`
+	MinIOEndpoint       Value      `yaml:"minio_endpoint,omitempty"`
+	GarageEndpoint      Value      `yaml:"garage_endpoint,omitempty"`
+	Region              Value      `yaml:"region,omitempty"`
+	SigningRegion       Value      `yaml:"signing_region,omitempty"`
+	ForcePathStyle      Value      `yaml:"force_path_style,omitempty"`
+	ChecksumMode        Value      `yaml:"checksum_mode,omitempty"`
+	InsecureSkipVerify  Value      `yaml:"insecure_skip_verify,omitempty"`
+	AccessKeyID         Value      `yaml:"access_key_id,omitempty"`
+	SecretAccessKey     Value      `yaml:"secret_access_key,omitempty"`
+	SecretAccessKeyFile Value      `yaml:"secret_access_key_file,omitempty"`
+	MinimalPermissions  Value      `yaml:"minimal_permissions,omitempty"`
+	SSE                 SSE        `yaml:"sse,omitempty"`
+	ObjectLock          ObjectLock `yaml:"object_lock,omitempty"`
+	StorageClass        Value      `yaml:"storage_class,omitempty"`
+	Tags                Pairs      `yaml:"tags,omitempty"`
+	Metadata            Pairs      `yaml:"metadata,omitempty"`
+}
+
+// AWS holds the standard AWS_* variables, which S3 clients fall back to.
+type AWS struct {
+	Region              Value `yaml:"region,omitempty"`
+	AccessKeyID         Value `yaml:"access_key_id,omitempty"`
+	SecretAccessKey     Value `yaml:"secret_access_key,omitempty"`
+	SecretAccessKeyFile Value `yaml:"secret_access_key_file,omitempty"`
+	SessionToken        Value `yaml:"session_token,omitempty"`
+	SessionTokenFile    Value `yaml:"session_token_file,omitempty"`
+}
+
+// SSE is the server-side encryption of an S3 destination.
+type SSE struct {
+	Mode            Value `yaml:"mode,omitempty"`
+	KMSKeyID        Value `yaml:"kms_key_id,omitempty"`
+	CustomerKey     Value `yaml:"customer_key,omitempty"`
+	CustomerKeyFile Value `yaml:"customer_key_file,omitempty"`
+}
+
+// ObjectLock is the Object Lock applied to archives in an S3 destination.
+type ObjectLock struct {
+	Mode      Value `yaml:"mode,omitempty"`
+	Period    Value `yaml:"period,omitempty"`
+	LegalHold Value `yaml:"legal_hold,omitempty"`
+}
+
+// Notifications configures who is told about finished runs.
+type Notifications struct {
+	Webhook Webhook `yaml:"webhook,omitempty"`
+}
+
+// Webhook receives a JSON event after runs.
+type Webhook struct {
+	URL     Value `yaml:"url,omitempty"`
+	URLFile Value `yaml:"url_file,omitempty"`
+	On      Value `yaml:"on,omitempty"`
+}
+
+// Value is a single setting, kept as the text of its environment variable.
+type Value string
+
+func (v *Value) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a single value", n.Line)
+	}
+	*v = Value(n.Value)
+	return nil
+}
+
+func (v Value) MarshalYAML() (any, error) {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: string(v)}, nil
+}
+
+// List is a setting with several values, written as a YAML sequence or a
+// comma separated string.
+type List []string
+
+func (l *List) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		*l = splitList(n.Value)
+	case yaml.SequenceNode:
+		*l = nil
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: expected a single value", item.Line)
+			}
+			*l = append(*l, item.Value)
+		}
+	default:
+		return fmt.Errorf("line %d: expected a list", n.Line)
+	}
+	return nil
+}
+
+// Pairs is a mapping of keys to values, such as object tags.
+type Pairs map[string]string
+
+// Load reads the configuration file at path, or only the environment if
+// path is empty. ${VAR} and ${VAR:-default} in values of the file are
+// replaced by environment variables, and $$ by $. Settings in the
+// environment override those in the file.
+func Load(path string) (*Config, error) {
+	c := &Config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read configuration: %w", err)
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(root.Content) > 0 {
+			errs := checkFields(root.Content[0], reflect.TypeFor[Config](), "")
+			errs = append(errs, interpolate(&root)...)
+			if len(errs) > 0 {
+				return nil, fmt.Errorf("%s: %w", path, errors.Join(errs...))
+			}
+			if err := root.Decode(c); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if err := c.mergeEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkFields reports the keys of n that are not settings of t.
+func checkFields(n *yaml.Node, t reflect.Type, path string) []error {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var errs []error
+	switch {
+	case t.Kind() == reflect.Map && t.Elem() != reflect.TypeFor[string]() && n.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			errs = append(errs, checkFields(n.Content[i+1], t.Elem(), path+n.Content[i].Value+".")...)
+		}
+
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := make(map[string]reflect.Type)
+		for f := range t.Fields() {
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			fields[name] = f.Type
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, fmt.Errorf("line %d: unknown setting %s%s", key.Line, path, key.Value))
+				continue
+			}
+			errs = append(errs, checkFields(n.Content[i+1], ft, path+key.Value+".")...)
+		}
+	}
+	return errs
+}
+
+var variablePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// interpolate replaces environment variable references in the scalar values
+// below n.
+func interpolate(n *yaml.Node) []error {
+	var errs []error
+	if n.Kind == yaml.ScalarNode {
+		n.Value = variablePattern.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if ref == "$$" {
+				return "$"
+			}
+			m := variablePattern.FindStringSubmatch(ref)
+			if value := os.Getenv(m[1]); value != "" {
+				return value
+			}
+			if fallback, ok := strings.CutPrefix(m[2], ":-"); ok {
+				return fallback
+			}
+			errs = append(errs, fmt.Errorf("line %d: environment variable %s is not set", n.Line, m[1]))
+			return ""
+		})
+	}
+	for i, child := range n.Content {
+		// Keys of mappings are never interpolated
+		if n.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		errs = append(errs, interpolate(child)...)
+	}
+	return errs
+}
+
+// mergeEnv overrides settings with the environment variables that are set.
+// DESTINATIONS replaces the destinations of the file, keeping the settings
+// of those it names.
+func (c *Config) mergeEnv() error {
+	if names := os.Getenv("DESTINATIONS"); names != "" {
+		destinations := make(map[string]*Destination)
+		for _, name := range splitList(names) {
+			name = strings.ToLower(name)
+			if d, ok := c.Destinations[name]; ok {
+				destinations[name] = d
+			} else {
+				destinations[name] = &Destination{}
+			}
+		}
+		c.Destinations = destinations
+	}
+
+	var errs []error
+	for _, b := range c.bindings() {
+		if value := os.Getenv(b.env); value != "" {
+			if err := b.set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s is invalid: %w", b.env, err))
+			}
+		} else if os.Getenv(counterpart(b.env)) != "" {
+			// A secret read from a file overrides the secret in the
+			// configuration file, and the other way round
+			b.set("")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks every setting and normalizes those that have several
+// spellings, reporting all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(b binding, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s (%s): %s", b.path, b.env, fmt.Sprintf(format, args...)))
+	}
+
+	bindings := c.bindings()
+	files := make(map[string]binding)
+	for _, b := range bindings {
+		files[b.env] = b
+	}
+
+	for _, b := range bindings {
+		value := b.get()
+		f, hasFile := files[b.env+secrets.FileSuffix]
+		if b.secret && hasFile && value != "" && f.get() != "" {
+			fail(b, "can't be set together with %s", f.path)
+		}
+		if value == "" {
+			switch {
+			case !b.required:
+			case !hasFile:
+				fail(b, "is required")
+			case f.get() == "":
+				fail(b, "is required (or %s)", f.path)
+			}
+			continue
+		}
+		if b.check == nil {
+			continue
+		}
+		normalized, err := b.check(value)
+		if err != nil {
+			fail(b, "%v", err)
+			continue
+		}
+		if normalized != value {
+			b.set(normalized)
+		}
+	}
+
+	if c.S3.Enabled == "true" && len(c.Destinations) == 0 {
+		if c.S3.Bucket == "" {
+			errs = append(errs, errors.New("s3.bucket (S3_BUCKET_NAME): is required with s3.enabled"))
+		}
+		if c.S3.ObjectLock.Mode != "" && c.S3.ObjectLock.Period == "" {
+			errs = append(errs, errors.New("s3.object_lock.period (S3_OBJECT_LOCK_PERIOD): is required with object_lock.mode"))
+		}
+		if c.S3.SSE.Mode == storage.SSEC && c.S3.SSE.CustomerKey == "" && c.S3.SSE.CustomerKeyFile == "" {
+			errs = append(errs, errors.New("s3.sse.customer_key (S3_SSE_CUSTOMER_KEY): is required with sse-c"))
+		}
+		if len(c.S3.Tags) > 10 {
+			errs = append(errs, errors.New("s3.tags (S3_TAGS): S3 allows at most 10 tags"))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Destinations)) {
+		if !file.TargetNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("destinations.%s: invalid name (expected lower case letters, digits, - and _)", name))
+		}
+		d := c.Destinations[name]
+		if d == nil {
+			errs = append(errs, fmt.Errorf("destinations.%s: has no settings", name))
+			continue
+		}
+		switch {
+		case d.Type == "local" && d.Dir == "":
+			errs = append(errs, fmt.Errorf("destinations.%s.dir: is required for local destinations", name))
+		case d.Type != "local" && d.Bucket == "":
+			errs = append(errs, fmt.Errorf("destinations.%s.bucket: is required for s3 destinations", name))
+		}
+		if d.ObjectLock.Mode != "" && d.ObjectLock.Period == "" {
+			errs = append(errs, fmt.Errorf("destinations.%s.object_lock.period: is required with object_lock.mode", name))
+		}
+		if d.SSE.Mode == storage.SSEC && d.SSE.CustomerKey == "" && d.SSE.CustomerKeyFile == "" {
+			errs = append(errs, fmt.Errorf("destinations.%s.sse.customer_key: is required with sse-c", name))
+		}
+		if len(d.Tags) > 10 {
+			errs = append(errs, fmt.Errorf("destinations.%s.tags: S3 allows at most 10 tags", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply exports the settings to the environment.
+func (c *Config) Apply() error {
+	if len(c.Destinations) > 0 {
+		names := slices.Sorted(maps.Keys(c.Destinations))
+		if err := os.Setenv("DESTINATIONS", strings.Join(names, ",")); err != nil {
+			return err
+		}
+	}
+	for _, b := range c.bindings() {
+		if value := b.get(); value != "" {
+			if err := os.Setenv(b.env, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of c with its secrets masked. Paths of files that
+// hold secrets are kept.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Destinations = make(map[string]*Destination, len(c.Destinations))
+	for name, d := range c.Destinations {
+		copied := *d
+		r.Destinations[name] = &copied
+	}
+	for _, b := range r.bindings() {
+		if b.secret && b.get() != "" {
+			b.set(secrets.Mask)
+		}
+	}
+	return &r
+}
+
+// Write prints c as YAML.
+func (c *Config) Write(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// counterpart pairs a secret variable with the *_FILE variable naming a file
+// that holds it, and the other way round. It returns "" for other variables.
+func counterpart(env string) string {
+	if name, ok := strings.CutSuffix(env, secrets.FileSuffix); ok && secrets.IsSecret(name) {
+		return name
+	}
+	if secrets.IsSecret(env) {
+		return env + secrets.FileSuffix
+	}
+	return ""
+}
+
+// splitList splits a comma separated value into its trimmed, non-empty
+// entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
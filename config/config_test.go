@@ -0,0 +1,294 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stenstromen/outlinewikibackup/secrets"
+)
+
+// writeConfig writes content to a configuration file and clears the
+// settings from the environment.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	for _, b := range (&Config{}).bindings() {
+		t.Setenv(b.env, "")
+	}
+	for _, key := range []string{"DESTINATIONS", "DEST_OFFSITE_BUCKET", "DEST_OFFSITE_PREFIX"} {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	return Load(writeConfig(t, content))
+}
+
+func TestLoadInterpolates(t *testing.T) {
+	path := writeConfig(t, `
+source:
+  url: ${OWB_TEST_URL:-https://fallback.example.com}
+  token: ${OWB_TEST_TOKEN}
+save_dir: /backups/$${OWB_TEST_TOKEN}
+`)
+	t.Setenv("OWB_TEST_URL", "")
+	t.Setenv("OWB_TEST_TOKEN", "")
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Load succeeded with an unset variable")
+	}
+	if !strings.Contains(err.Error(), "line 4: environment variable OWB_TEST_TOKEN is not set") {
+		t.Errorf("error %q doesn't name the line and variable", err)
+	}
+
+	t.Setenv("OWB_TEST_TOKEN", "s3cret")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source.URL != "https://fallback.example.com" {
+		t.Errorf("url = %q, want the default", c.Source.URL)
+	}
+	if c.Source.Token != "s3cret" {
+		t.Errorf("token = %q, want the variable", c.Source.Token)
+	}
+	if c.SaveDir != "/backups/${OWB_TEST_TOKEN}" {
+		t.Errorf("save_dir = %q, want $$ kept as $", c.SaveDir)
+	}
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	_, err := load(t, `
+source:
+  url: https://wiki.example.com
+  tokn: x
+destinations:
+  offsite:
+    type: s3
+    bukket: backups
+`)
+	if err == nil {
+		t.Fatal("Load succeeded with unknown settings")
+	}
+	for _, want := range []string{"line 4: unknown setting source.tokn", "line 8: unknown setting destinations.offsite.bukket"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestEnvironmentOverridesFile(t *testing.T) {
+	content := `
+source:
+  url: https://file.example.com
+  token: from-file
+destinations:
+  onprem:
+    type: local
+    dir: /backups
+  offsite:
+    type: s3
+    bucket: file-bucket
+`
+	path := writeConfig(t, content)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Destinations) != 2 {
+		t.Errorf("got %d destinations, want 2", len(c.Destinations))
+	}
+
+	t.Setenv("API_BASE_URL", "https://env.example.com")
+	t.Setenv("DESTINATIONS", "offsite")
+	t.Setenv("DEST_OFFSITE_PREFIX", "wiki/")
+	c, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source.URL != "https://env.example.com" {
+		t.Errorf("url = %q, want the environment's", c.Source.URL)
+	}
+	if c.Source.Token != "from-file" {
+		t.Errorf("token = %q, want the file's", c.Source.Token)
+	}
+	offsite, ok := c.Destinations["offsite"]
+	if len(c.Destinations) != 1 || !ok {
+		t.Fatalf("destinations = %v, want only offsite", c.Destinations)
+	}
+	if offsite.Bucket != "file-bucket" || offsite.Prefix != "wiki/" {
+		t.Errorf("offsite = bucket %q prefix %q, want the file's bucket and the environment's prefix", offsite.Bucket, offsite.Prefix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"valid", `
+source:
+  url: https://wiki.example.com
+  token: t
+`, nil},
+		{"invalid bool", `
+source:
+  url: https://wiki.example.com
+  token: t
+s3:
+  enabled: yes
+`, []string{"s3.enabled (UPLOAD_TO_S3): \"yes\" is not true or false"}},
+		{"required", `
+save_dir: /backups
+`, []string{"source.url (API_BASE_URL): is required", "source.token (AUTH_TOKEN): is required (or source.token_file)"}},
+		{"token file", `
+source:
+  url: https://wiki.example.com
+  token_file: /run/secrets/token
+`, nil},
+		{"token and token file", `
+source:
+  url: https://wiki.example.com
+  token: t
+  token_file: /run/secrets/token
+`, []string{"source.token (AUTH_TOKEN): can't be set together with source.token_file"}},
+		{"invalid values", `
+source:
+  url: ftp://wiki.example.com
+  token: t
+  poll_interval: soon
+schedule: "61 * * * *"
+`, []string{"source.url (API_BASE_URL): not an http or https URL", "source.poll_interval (SLEEP_DURATION)", "schedule (SCHEDULE)"}},
+		{"destinations", `
+source:
+  url: https://wiki.example.com
+  token: t
+destinations:
+  onprem:
+    type: local
+  offsite:
+    type: s3
+    object_lock:
+      mode: governance
+`, []string{"destinations.onprem.dir: is required", "destinations.offsite.bucket: is required", "destinations.offsite.object_lock.period: is required"}},
+		{"default s3", `
+source:
+  url: https://wiki.example.com
+  token: t
+s3:
+  enabled: True
+  force_path_style: maybe
+  sse:
+    mode: sse-c
+`, []string{"s3.force_path_style (S3_FORCE_PATH_STYLE)", "s3.bucket (S3_BUCKET_NAME): is required", "s3.sse.customer_key (S3_SSE_CUSTOMER_KEY): is required"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := load(t, tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate() succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultS3FromEnvironment(t *testing.T) {
+	path := writeConfig(t, `
+source:
+  url: https://wiki.example.com
+  token: t
+`)
+	t.Setenv("UPLOAD_TO_S3", "TRUE")
+	t.Setenv("S3_BUCKET_NAME", "backups")
+	t.Setenv("S3_PROVIDER", "MinIO")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "hunter22")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.S3.Enabled != "true" || c.S3.Provider != "minio" {
+		t.Errorf("enabled %q, provider %q, want them normalized", c.S3.Enabled, c.S3.Provider)
+	}
+
+	if err := c.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("UPLOAD_TO_S3"); got != "true" {
+		t.Errorf("UPLOAD_TO_S3 = %q after Apply, want true", got)
+	}
+
+	var out strings.Builder
+	if err := c.Redacted().Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"s3:\n  enabled: true\n  bucket: backups", "aws:\n  secret_access_key: '" + secrets.Mask} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("written configuration doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c, err := load(t, `
+source:
+  url: https://wiki.example.com
+  token: s3cret
+destinations:
+  offsite:
+    type: s3
+    bucket: backups
+    secret_access_key_file: /run/secrets/key
+  onprem:
+    type: s3
+    bucket: backups
+    secret_access_key: hunter22
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := c.Redacted()
+	if r.Source.Token != secrets.Mask || r.Destinations["onprem"].SecretAccessKey != secrets.Mask {
+		t.Errorf("secrets not masked: token %q, secret key %q", r.Source.Token, r.Destinations["onprem"].SecretAccessKey)
+	}
+	if r.Destinations["offsite"].SecretAccessKeyFile != "/run/secrets/key" {
+		t.Errorf("secret_access_key_file = %q, want the path kept", r.Destinations["offsite"].SecretAccessKeyFile)
+	}
+	if c.Source.Token != "s3cret" || c.Destinations["onprem"].SecretAccessKey != "hunter22" {
+		t.Error("Redacted changed the original configuration")
+	}
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cret") || strings.Contains(out.String(), "hunter22") {
+		t.Errorf("written configuration contains a secret:\n%s", out.String())
+	}
+}
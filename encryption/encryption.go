@@ -0,0 +1,261 @@
+// Package encryption encrypts backup archives with age or OpenPGP before
+// they are stored, and decrypts them again for restores.
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Suffixes appended to the names of encrypted archives.
+const (
+	SuffixAge = ".age"
+	SuffixPGP = ".gpg"
+)
+
+// Encrypter encrypts archives for a fixed set of recipients.
+type Encrypter interface {
+	// String describes the encryption in log messages.
+	String() string
+	// Suffix is appended to the names of encrypted archives.
+	Suffix() string
+	// Encrypt returns a writer that encrypts everything written to it into
+	// w. It must be closed to flush the end of the ciphertext; w is left
+	// open.
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+}
+
+// FromEnv returns the encrypter configured by ENCRYPTION_AGE_RECIPIENTS,
+// ENCRYPTION_AGE_RECIPIENTS_FILE or ENCRYPTION_PGP_PUBLIC_KEY_FILE, or nil
+// when archives are stored unencrypted.
+func FromEnv() (Encrypter, error) {
+	recipients := os.Getenv("ENCRYPTION_AGE_RECIPIENTS")
+	recipientsFile := os.Getenv("ENCRYPTION_AGE_RECIPIENTS_FILE")
+	publicKeyFile := os.Getenv("ENCRYPTION_PGP_PUBLIC_KEY_FILE")
+
+	useAge := recipients != "" || recipientsFile != ""
+	if useAge && publicKeyFile != "" {
+		return nil, errors.New("age and OpenPGP encryption can't be used together")
+	}
+
+	switch {
+	case useAge:
+		return newAgeEncrypter(recipients, recipientsFile)
+	case publicKeyFile != "":
+		return newPGPEncrypter(publicKeyFile)
+	}
+	return nil, nil
+}
+
+// Reader returns the ciphertext of everything read from r. Closing it stops
+// the encryption early and waits until r is no longer read from, so that r
+// can be closed or inspected afterwards.
+func Reader(e Encrypter, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := e.Encrypt(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return &sealedReader{PipeReader: pr, done: done}
+}
+
+// sealedReader is the read end of the pipe Reader encrypts into.
+type sealedReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (s *sealedReader) Close() error {
+	err := s.PipeReader.Close()
+	<-s.done
+	return err
+}
+
+// IsEncrypted reports whether name has the suffix of an encrypted archive.
+func IsEncrypted(name string) bool {
+	return strings.HasSuffix(name, SuffixAge) || strings.HasSuffix(name, SuffixPGP)
+}
+
+// TrimSuffix returns name without the suffix of an encrypted archive.
+func TrimSuffix(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, SuffixAge), SuffixPGP)
+}
+
+type ageEncrypter struct {
+	recipients []age.Recipient
+}
+
+func newAgeEncrypter(recipients, recipientsFile string) (*ageEncrypter, error) {
+	e := &ageEncrypter{}
+	for _, value := range strings.Split(recipients, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		r, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_AGE_RECIPIENTS is invalid: %w", err)
+		}
+		e.recipients = append(e.recipients, r)
+	}
+
+	if recipientsFile != "" {
+		f, err := os.Open(recipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ENCRYPTION_AGE_RECIPIENTS_FILE: %w", err)
+		}
+		defer f.Close()
+		recipients, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_AGE_RECIPIENTS_FILE is invalid: %w", err)
+		}
+		e.recipients = append(e.recipients, recipients...)
+	}
+
+	if len(e.recipients) == 0 {
+		return nil, errors.New("no age recipients configured")
+	}
+	return e, nil
+}
+
+func (e *ageEncrypter) String() string {
+	return fmt.Sprintf("age, %d recipients", len(e.recipients))
+}
+
+func (e *ageEncrypter) Suffix() string { return SuffixAge }
+
+func (e *ageEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+type pgpEncrypter struct {
+	keys openpgp.EntityList
+}
+
+func newPGPEncrypter(publicKeyFile string) (*pgpEncrypter, error) {
+	keys, err := readKeyRing(publicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ENCRYPTION_PGP_PUBLIC_KEY_FILE is invalid: %w", err)
+	}
+	e := &pgpEncrypter{keys: keys}
+
+	// Fail now rather than on the first backup if a key can't encrypt
+	w, err := e.Encrypt(io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("ENCRYPTION_PGP_PUBLIC_KEY_FILE is unusable: %w", err)
+	}
+	w.Close()
+	return e, nil
+}
+
+func (e *pgpEncrypter) String() string {
+	return fmt.Sprintf("OpenPGP, %d keys", len(e.keys))
+}
+
+func (e *pgpEncrypter) Suffix() string { return SuffixPGP }
+
+func (e *pgpEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return openpgp.Encrypt(w, e.keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+}
+
+// readKeyRing reads an OpenPGP key ring in either armored or binary form.
+func readKeyRing(filename string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err == nil {
+		return keys, nil
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// Decrypter decrypts archives encrypted by an Encrypter.
+type Decrypter struct {
+	identities []age.Identity
+	keys       openpgp.EntityList
+}
+
+// DecrypterFromEnv returns a decrypter holding the age identities in
+// ENCRYPTION_AGE_IDENTITY_FILE and the OpenPGP private keys in
+// ENCRYPTION_PGP_PRIVATE_KEY_FILE, unlocked with ENCRYPTION_PGP_PASSPHRASE.
+func DecrypterFromEnv() (*Decrypter, error) {
+	d := &Decrypter{}
+
+	if filename := os.Getenv("ENCRYPTION_AGE_IDENTITY_FILE"); filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ENCRYPTION_AGE_IDENTITY_FILE: %w", err)
+		}
+		defer f.Close()
+		if d.identities, err = age.ParseIdentities(f); err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_AGE_IDENTITY_FILE is invalid: %w", err)
+		}
+	}
+
+	if filename := os.Getenv("ENCRYPTION_PGP_PRIVATE_KEY_FILE"); filename != "" {
+		keys, err := readKeyRing(filename)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_PGP_PRIVATE_KEY_FILE is invalid: %w", err)
+		}
+		passphrase := os.Getenv("ENCRYPTION_PGP_PASSPHRASE")
+		for _, key := range keys {
+			if key.PrivateKey == nil {
+				return nil, errors.New("ENCRYPTION_PGP_PRIVATE_KEY_FILE holds a public key")
+			}
+			if passphrase == "" {
+				if key.PrivateKey.Encrypted {
+					return nil, errors.New("ENCRYPTION_PGP_PRIVATE_KEY_FILE is protected by a passphrase, but ENCRYPTION_PGP_PASSPHRASE is not set")
+				}
+				continue
+			}
+			if err := key.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("unable to unlock ENCRYPTION_PGP_PRIVATE_KEY_FILE: %w", err)
+			}
+		}
+		d.keys = keys
+	}
+
+	return d, nil
+}
+
+// Decrypt returns the plaintext of the archive named name read from r,
+// choosing the format by its suffix. Archives without an encryption suffix
+// are returned as they are. The plaintext has been authenticated only once
+// it has been read to the end without an error.
+func (d *Decrypter) Decrypt(name string, r io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(name, SuffixAge):
+		if len(d.identities) == 0 {
+			return nil, errors.New("ENCRYPTION_AGE_IDENTITY_FILE is not set")
+		}
+		return age.Decrypt(r, d.identities...)
+
+	case strings.HasSuffix(name, SuffixPGP):
+		if len(d.keys) == 0 {
+			return nil, errors.New("ENCRYPTION_PGP_PRIVATE_KEY_FILE is not set")
+		}
+		md, err := openpgp.ReadMessage(r, d.keys, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return md.UnverifiedBody, nil
+	}
+	return r, nil
+}
@@ -1,135 +1,227 @@
 package file
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/stenstromen/outlinewikibackup/s3api"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/stenstromen/outlinewikibackup/api"
+	"github.com/stenstromen/outlinewikibackup/retention"
+	"github.com/stenstromen/outlinewikibackup/storage"
 )
 
-func UploadToS3(filename string) error {
-	cfg := s3api.GetConfig()
-	s3Client := s3.NewFromConfig(cfg)
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("unable to open file %q: %w", filename, err)
+const (
+	defaultPartSizeMiB       = 16
+	defaultUploadConcurrency = manager.DefaultUploadConcurrency
+)
+
+// UploadSettings controls how archives are split into parts for S3
+// multipart uploads.
+type UploadSettings struct {
+	PartSize    int64
+	Concurrency int
+}
+
+// GetUploadSettings reads S3_PART_SIZE (in MiB) and S3_UPLOAD_CONCURRENCY.
+func GetUploadSettings() (UploadSettings, error) {
+	settings := UploadSettings{
+		PartSize:    defaultPartSizeMiB * 1024 * 1024,
+		Concurrency: defaultUploadConcurrency,
 	}
-	defer file.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("unable to get file info for %q: %w", filename, err)
+	if value := os.Getenv("S3_PART_SIZE"); value != "" {
+		mib, err := strconv.Atoi(value)
+		if err != nil || int64(mib)*1024*1024 < manager.MinUploadPartSize {
+			return settings, fmt.Errorf("S3_PART_SIZE is invalid: %q (expected a number of MiB, at least 5)", value)
+		}
+		settings.PartSize = int64(mib) * 1024 * 1024
 	}
 
-	var size = fileInfo.Size()
-	buffer := make([]byte, size)
-	_, err = file.Read(buffer)
-	if err != nil {
-		return fmt.Errorf("unable to read file %q: %w", filename, err)
+	if value := os.Getenv("S3_UPLOAD_CONCURRENCY"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return settings, fmt.Errorf("S3_UPLOAD_CONCURRENCY is invalid: %q (expected a positive number)", value)
+		}
+		settings.Concurrency = n
+	}
+
+	return settings, nil
+}
+
+// ChecksumSuffix is appended to an archive's key to name the sidecar that
+// holds its SHA-256.
+const ChecksumSuffix = ".sha256"
+
+// WriteChecksum stores the hex encoded SHA-256 of the archive key in dest as
+// its sidecar, in the format of sha256sum so that it can be checked with
+// "sha256sum -c".
+func WriteChecksum(ctx context.Context, dest storage.Destination, key, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, key)
+	if err := dest.Put(ctx, key+ChecksumSuffix, strings.NewReader(line), nil); err != nil {
+		return fmt.Errorf("unable to store checksum of %q: %w", key, err)
 	}
+	return nil
+}
 
-	_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET_NAME")),
-		Key:    aws.String(filepath.Base(filename)),
-		Body:   bytes.NewReader(buffer),
-		ACL:    types.ObjectCannedACLPrivate,
-	})
+// ReadChecksum returns the hex encoded SHA-256 of the archive at path from
+// its sidecar.
+func ReadChecksum(path string) (string, error) {
+	data, err := os.ReadFile(path + ChecksumSuffix)
 	if err != nil {
-		return fmt.Errorf("unable to upload %q to %q: %w", filename, os.Getenv("S3_BUCKET_NAME"), err)
+		return "", err
 	}
+	sum, _, _ := strings.Cut(string(data), " ")
+	if len(sum) != 64 {
+		return "", fmt.Errorf("%q is not a SHA-256 checksum file", path+ChecksumSuffix)
+	}
+	return strings.ToLower(sum), nil
+}
 
-	log.Println("Successfully uploaded", filename, "to", os.Getenv("S3_BUCKET_NAME"))
-	return nil
+// SaveDir returns SAVE_DIR or its default.
+func SaveDir() string {
+	if dir := os.Getenv("SAVE_DIR"); dir != "" {
+		return dir
+	}
+	return "/tmp/outlinewikibackups"
 }
 
-func KeepOnlyNBackups(keepBackups string) error {
-	s3env := os.Getenv("UPLOAD_TO_S3")
-	keepBackupsInt, err := strconv.Atoi(keepBackups)
+// exportsFile lists the IDs of the exports this tool started and hasn't
+// deleted yet, one per line.
+const exportsFile = ".outlinewikibackup-exports"
+
+// StartedExports returns the IDs recorded by RecordExport in SAVE_DIR.
+func StartedExports() (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(SaveDir(), exportsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	if s3env == "true" {
-		// Skip S3 backup cleanup if MINIMAL_S3_PERMISSIONS is enabled
-		// because minimal permissions don't include ListObjectsV2
-		if os.Getenv("MINIMAL_S3_PERMISSIONS") == "true" {
-			log.Println("Skipping S3 backup cleanup due to minimal permissions (MINIMAL_S3_PERMISSIONS enabled)")
-			return nil
+	ids := make(map[string]bool)
+	for _, id := range strings.Fields(string(data)) {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// RecordExport notes in SAVE_DIR that this tool started the export id, so
+// that later runs may reuse or delete it if this one can't.
+func RecordExport(id string) error {
+	dir := SaveDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, exportsFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, id); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ForgetExports removes ids from the exports recorded in SAVE_DIR.
+func ForgetExports(ids ...string) error {
+	started, err := StartedExports()
+	if err != nil || len(started) == 0 {
+		return err
+	}
+	var kept strings.Builder
+	for id := range started {
+		if !slices.Contains(ids, id) {
+			fmt.Fprintln(&kept, id)
 		}
+	}
+	return os.WriteFile(filepath.Join(SaveDir(), exportsFile), []byte(kept.String()), 0600)
+}
 
-		cfg := s3api.GetConfig()
-		s3Client := s3.NewFromConfig(cfg)
+// PruneBackups deletes the archives in dest that policy doesn't keep. Only
+// objects whose name matches pattern are considered, so other data sharing
+// the bucket or directory is never touched. Backups are dated by the time in
+// their name, or by their modification time if it has none, and the policy
+// counts each format and collection separately. With dryRun set
+// every decision is logged and nothing is deleted. Backups that are still
+// locked are kept and reported. The checksum sidecar of a backup is deleted
+// with it.
+func PruneBackups(ctx context.Context, dest storage.Destination, policy retention.Policy, pattern *regexp.Regexp, dryRun bool) error {
+	all, err := dest.List(ctx)
+	if errors.Is(err, storage.ErrNotSupported) {
+		log.Println("Skipping backup cleanup of", dest.String()+":", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		resp, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-			Bucket: aws.String(os.Getenv("S3_BUCKET_NAME")),
-		})
-		if err != nil {
-			return fmt.Errorf("unable to list objects in bucket %q: %w", os.Getenv("S3_BUCKET_NAME"), err)
+	var backups []retention.Backup
+	sidecars := 0
+	for _, obj := range all {
+		if !pattern.MatchString(obj.Key) {
+			if name, ok := strings.CutSuffix(obj.Key, ChecksumSuffix); ok && pattern.MatchString(name) {
+				sidecars++
+			}
+			continue
 		}
+		t, ok := api.ArchiveTime(obj.Key)
+		if !ok {
+			t = obj.LastModified
+		}
+		// Archives named before the format was part of the name form a
+		// series of their own
+		series, _ := api.ArchiveSeries(obj.Key)
+		backups = append(backups, retention.Backup{Object: obj, Time: t, Series: series})
+	}
+	if ignored := len(all) - len(backups) - sidecars; ignored > 0 {
+		log.Println("Ignoring", ignored, "objects in", dest.String(), "that aren't backups of this instance")
+	}
 
-		sortS3ObjectsByLastModified(resp.Contents)
-
-		numObjects := len(resp.Contents)
-		numToDelete := numObjects - keepBackupsInt
-		if numToDelete > 0 {
-			objectsToDelete := resp.Contents[:numToDelete]
-			for _, obj := range objectsToDelete {
-				_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-					Bucket: aws.String(os.Getenv("S3_BUCKET_NAME")),
-					Key:    obj.Key,
-				})
-				if err != nil {
-					return fmt.Errorf("unable to delete object %q: %w", *obj.Key, err)
-				}
-				log.Println("Deleted object:", *obj.Key)
+	for _, d := range policy.Apply(backups, time.Now()) {
+		reasons := strings.Join(d.Reasons, ", ")
+		if d.Keep {
+			if dryRun {
+				log.Printf("Would keep %s (%s)", d.Key, reasons)
 			}
+			continue
 		}
-	} else {
-		saveDir := os.Getenv("SAVE_DIR")
-		if saveDir == "" {
-			saveDir = "/tmp/outlinewikibackups"
+		if dryRun {
+			log.Printf("Would delete %s (%s)", d.Key, reasons)
+			continue
 		}
 
-		files, err := os.ReadDir(saveDir)
+		err := dest.Delete(ctx, d.Key)
+		if errors.Is(err, storage.ErrLocked) {
+			log.Printf("Keeping backup %s: %v", d.Key, err)
+			continue
+		}
+		if errors.Is(err, storage.ErrNotSupported) {
+			log.Println("Skipping backup cleanup of", dest.String()+":", err)
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("unable to list files in directory %q: %w", saveDir, err)
+			return fmt.Errorf("unable to delete %q: %w", d.Key, err)
 		}
+		log.Printf("Deleted backup: %s (%s)", d.Key, reasons)
 
-		sortFilesByLastModified(files)
-
-		numFiles := len(files)
-		numToDelete := numFiles - keepBackupsInt
-		if numToDelete > 0 {
-			filesToDelete := files[:numToDelete]
-			for _, file := range filesToDelete {
-				if err := os.Remove(filepath.Join(saveDir, file.Name())); err != nil {
-					return fmt.Errorf("unable to delete file %q: %w", file.Name(), err)
-				}
-				log.Println("Deleted file:", file.Name())
-			}
+		err = dest.Delete(ctx, d.Key+ChecksumSuffix)
+		if errors.Is(err, storage.ErrLocked) {
+			log.Printf("Keeping checksum of %s: %v", d.Key, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to delete %q: %w", d.Key+ChecksumSuffix, err)
 		}
 	}
 	return nil
 }
-
-func sortS3ObjectsByLastModified(objects []types.Object) {
-	sort.Slice(objects, func(i, j int) bool {
-		return objects[i].LastModified.Before(*objects[j].LastModified)
-	})
-}
-
-func sortFilesByLastModified(files []os.DirEntry) {
-	sort.Slice(files, func(i, j int) bool {
-		file1, _ := files[i].Info()
-		file2, _ := files[j].Info()
-		return file1.ModTime().Before(file2.ModTime())
-	})
-}
@@ -0,0 +1,112 @@
+package file
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stenstromen/outlinewikibackup/api"
+	"github.com/stenstromen/outlinewikibackup/retention"
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+const (
+	markdown1 = "wiki.example.com-outline-backup-markdown-2025-03-11T02:00:00Z.zip"
+	markdown2 = "wiki.example.com-outline-backup-markdown-2025-03-12T02:00:00Z.zip"
+	markdown3 = "wiki.example.com-outline-backup-markdown-2025-03-13T02:00:00Z.zip"
+	json1     = "wiki.example.com-outline-backup-json-eng-eng8h2KdLq-2025-03-11T02:00:00Z.zip.age"
+	json2     = "wiki.example.com-outline-backup-json-eng-eng8h2KdLq-2025-03-12T02:00:00Z.zip.gpg"
+	renamed   = "wiki.example.com-outline-backup-json-platform-eng8h2KdLq-2025-03-13T02:00:00Z.zip.age"
+	legacy1   = "wiki.example.com-outline-backup-2025-03-01T02:00:00Z.zip"
+	legacy2   = "wiki.example.com-outline-backup-2025-03-02T02:00:00+01:00.zip"
+	other1    = "other.example.com-outline-backup-markdown-2025-03-11T02:00:00Z.zip"
+	other2    = "other.example.com-outline-backup-2025-03-01T02:00:00Z.zip"
+	notes     = "notes.txt"
+)
+
+func TestPruneBackups(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	c, err := api.NewClient(api.Options{BaseURL: "https://wiki.example.com", Token: "test-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		files  []string
+		policy retention.Policy
+		dryRun bool
+		want   []string
+	}{
+		{
+			name:   "each series",
+			files:  []string{markdown1, markdown2, markdown3, json1, json2, legacy1, legacy2},
+			policy: retention.Policy{Last: 1},
+			want:   []string{markdown3, json2, legacy2},
+		},
+		{
+			name:   "renamed collection",
+			files:  []string{json1, json2, renamed},
+			policy: retention.Policy{Last: 1},
+			want:   []string{renamed},
+		},
+		{
+			name:   "sidecars",
+			files:  []string{markdown1, markdown1 + ChecksumSuffix, markdown2, markdown2 + ChecksumSuffix, legacy1 + ChecksumSuffix},
+			policy: retention.Policy{Last: 1},
+			// A sidecar without its archive is left alone
+			want: []string{markdown2, markdown2 + ChecksumSuffix, legacy1 + ChecksumSuffix},
+		},
+		{
+			name:   "other files",
+			files:  []string{markdown1, markdown2, other1, other2, other2 + ChecksumSuffix, notes},
+			policy: retention.Policy{Last: 1},
+			want:   []string{markdown2, other1, other2, other2 + ChecksumSuffix, notes},
+		},
+		{
+			name:   "dry run",
+			files:  []string{markdown1, markdown1 + ChecksumSuffix, markdown2, legacy1, legacy2},
+			policy: retention.Policy{Last: 1},
+			dryRun: true,
+			want:   []string{markdown1, markdown1 + ChecksumSuffix, markdown2, legacy1, legacy2},
+		},
+		{
+			name:  "no policy",
+			files: []string{markdown1, markdown2, legacy1},
+			want:  []string{markdown1, markdown2, legacy1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := PruneBackups(context.Background(), storage.NewLocal(dir), tt.policy, c.ArchivePattern(), tt.dryRun); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(got, want) {
+				t.Errorf("left\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
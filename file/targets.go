@@ -0,0 +1,298 @@
+package file
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stenstromen/outlinewikibackup/retention"
+	"github.com/stenstromen/outlinewikibackup/s3api"
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+const (
+	targetTypeS3    = "s3"
+	targetTypeLocal = "local"
+)
+
+// TargetNamePattern matches the names of destinations in DESTINATIONS.
+var TargetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Target is a named destination with its own retention.
+type Target struct {
+	Name        string
+	Destination storage.Destination
+	Retention   retention.Policy
+}
+
+// NewTargets returns the destinations named in DESTINATIONS, each configured
+// by its DEST_<NAME>_* variables. Without DESTINATIONS it returns a single
+// target: the S3/MinIO bucket when UPLOAD_TO_S3 is "true" and the SAVE_DIR
+// directory otherwise, with the retention policy of the KEEP_* variables.
+func NewTargets(ctx context.Context) ([]Target, error) {
+	names := strings.TrimSpace(os.Getenv("DESTINATIONS"))
+	if names == "" {
+		return defaultTargets(ctx)
+	}
+
+	var targets []Target
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !TargetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("DESTINATIONS contains an invalid name: %q (expected letters, digits, - and _)", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("DESTINATIONS names %q more than once", name)
+		}
+		seen[name] = true
+
+		target, err := newTarget(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %w", name, err)
+		}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("DESTINATIONS does not name any destination")
+	}
+	return targets, nil
+}
+
+func defaultTargets(ctx context.Context) ([]Target, error) {
+	policy, err := retention.PolicyFromEnv("")
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("UPLOAD_TO_S3") != "true" {
+		return []Target{{
+			Name:        targetTypeLocal,
+			Destination: storage.NewLocal(SaveDir()),
+			Retention:   policy,
+		}}, nil
+	}
+
+	settings, err := GetUploadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	s3Settings, err := s3api.DefaultSettings()
+	if err != nil {
+		return nil, err
+	}
+	sse, lock, err := s3Protection("S3_")
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3api.NewClient(ctx, s3Settings)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := storage.S3Options{
+		Bucket:      os.Getenv("S3_BUCKET_NAME"),
+		PartSize:    settings.PartSize,
+		Concurrency: settings.Concurrency,
+		// Minimal permissions don't include ListObjectsV2
+		MinimalPermissions: os.Getenv("MINIMAL_S3_PERMISSIONS") == "true",
+		SSE:                sse,
+		Lock:               lock,
+	}
+	if err := s3Labels("S3_", &opts); err != nil {
+		return nil, err
+	}
+
+	return []Target{{
+		Name:        targetTypeS3,
+		Destination: storage.NewS3(client, opts),
+		Retention:   policy,
+	}}, nil
+}
+
+func newTarget(ctx context.Context, name string) (Target, error) {
+	prefix := "DEST_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	env := func(key string) string {
+		return os.Getenv(prefix + key)
+	}
+
+	policy, err := retention.PolicyFromEnv(prefix)
+	if err != nil {
+		return Target{}, err
+	}
+	target := Target{Name: name, Retention: policy}
+
+	switch kind := env("TYPE"); kind {
+	case targetTypeLocal:
+		dir := env("DIR")
+		if dir == "" {
+			return Target{}, fmt.Errorf("%sDIR is not set", prefix)
+		}
+		target.Destination = storage.NewLocal(dir)
+
+	case "", targetTypeS3:
+		bucket := env("BUCKET")
+		if bucket == "" {
+			return Target{}, fmt.Errorf("%sBUCKET is not set", prefix)
+		}
+		settings, err := GetUploadSettings()
+		if err != nil {
+			return Target{}, err
+		}
+		s3Settings, err := s3api.SettingsFromEnv(prefix)
+		if err != nil {
+			return Target{}, err
+		}
+		sse, lock, err := s3Protection(prefix)
+		if err != nil {
+			return Target{}, err
+		}
+		client, err := s3api.NewClient(ctx, s3Settings)
+		if err != nil {
+			return Target{}, err
+		}
+		opts := storage.S3Options{
+			Bucket:             bucket,
+			Prefix:             env("PREFIX"),
+			PartSize:           settings.PartSize,
+			Concurrency:        settings.Concurrency,
+			MinimalPermissions: env("MINIMAL_PERMISSIONS") == "true",
+			SSE:                sse,
+			Lock:               lock,
+		}
+		if err := s3Labels(prefix, &opts); err != nil {
+			return Target{}, err
+		}
+		target.Destination = storage.NewS3(client, opts)
+
+	default:
+		return Target{}, fmt.Errorf("%sTYPE is invalid: %q (expected %q or %q)", prefix, kind, targetTypeS3, targetTypeLocal)
+	}
+
+	return target, nil
+}
+
+// s3Protection reads the server-side encryption and Object Lock settings of
+// an S3 destination from the variables named prefix followed by SSE,
+// SSE_KMS_KEY_ID, SSE_CUSTOMER_KEY, OBJECT_LOCK_MODE, OBJECT_LOCK_PERIOD and
+// OBJECT_LOCK_LEGAL_HOLD.
+func s3Protection(prefix string) (storage.SSE, storage.ObjectLock, error) {
+	env := func(key string) string {
+		return os.Getenv(prefix + key)
+	}
+
+	sse := storage.SSE{Mode: strings.ToLower(env("SSE"))}
+	switch sse.Mode {
+	case "":
+	case storage.SSES3:
+	case storage.SSEKMS:
+		sse.KMSKeyID = env("SSE_KMS_KEY_ID")
+	case storage.SSEC:
+		key, err := base64.StdEncoding.DecodeString(env("SSE_CUSTOMER_KEY"))
+		if err != nil || len(key) != 32 {
+			return sse, storage.ObjectLock{}, fmt.Errorf("%sSSE_CUSTOMER_KEY is invalid (expected a base64 encoded 256-bit key)", prefix)
+		}
+		sse.CustomerKey = key
+	default:
+		return sse, storage.ObjectLock{}, fmt.Errorf("%sSSE is invalid: %q (expected %s, %s or %s)", prefix, sse.Mode, storage.SSES3, storage.SSEKMS, storage.SSEC)
+	}
+
+	var lock storage.ObjectLock
+	mode, period := strings.ToUpper(env("OBJECT_LOCK_MODE")), env("OBJECT_LOCK_PERIOD")
+	switch lockMode := types.ObjectLockMode(mode); lockMode {
+	case "":
+		if period != "" {
+			return sse, lock, fmt.Errorf("%sOBJECT_LOCK_PERIOD is set without %sOBJECT_LOCK_MODE", prefix, prefix)
+		}
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return sse, lock, fmt.Errorf("%sOBJECT_LOCK_PERIOD is invalid: %q (expected a positive duration such as 720h)", prefix, period)
+		}
+		lock.Mode, lock.Period = lockMode, d
+	default:
+		return sse, lock, fmt.Errorf("%sOBJECT_LOCK_MODE is invalid: %q (expected governance or compliance)", prefix, mode)
+	}
+
+	if value := env("OBJECT_LOCK_LEGAL_HOLD"); value != "" {
+		hold, err := strconv.ParseBool(value)
+		if err != nil {
+			return sse, lock, fmt.Errorf("%sOBJECT_LOCK_LEGAL_HOLD is invalid: %q (expected true or false)", prefix, value)
+		}
+		lock.LegalHold = hold
+	}
+
+	return sse, lock, nil
+}
+
+// maxTags is the number of tags S3 allows on an object.
+const maxTags = 10
+
+// s3Labels reads the storage class, tags and metadata of the archives in an
+// S3 destination into opts, from the variables named prefix followed by
+// STORAGE_CLASS, TAGS and METADATA. Tags and metadata are comma separated
+// key=value pairs.
+func s3Labels(prefix string, opts *storage.S3Options) error {
+	if value := strings.ToUpper(os.Getenv(prefix + "STORAGE_CLASS")); value != "" {
+		class := types.StorageClass(value)
+		if !slices.Contains(class.Values(), class) {
+			return fmt.Errorf("%sSTORAGE_CLASS is invalid: %q (expected an S3 storage class such as STANDARD_IA or GLACIER_IR)", prefix, value)
+		}
+		opts.StorageClass = class
+	}
+
+	tags, err := ParsePairs(os.Getenv(prefix + "TAGS"))
+	if err != nil {
+		return fmt.Errorf("%sTAGS is invalid: %w", prefix, err)
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("%sTAGS is invalid: S3 allows at most %d tags", prefix, maxTags)
+	}
+	opts.Tags = tags
+
+	metadata, err := ParsePairs(os.Getenv(prefix + "METADATA"))
+	if err != nil {
+		return fmt.Errorf("%sMETADATA is invalid: %w", prefix, err)
+	}
+	if len(metadata) > 0 {
+		opts.Metadata = make(storage.Metadata, len(metadata))
+		for k, v := range metadata {
+			opts.Metadata[strings.ToLower(k)] = v
+		}
+	}
+
+	return nil
+}
+
+// ParsePairs parses comma separated key=value pairs.
+func ParsePairs(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		pairs[k] = strings.TrimSpace(v)
+	}
+	return pairs, nil
+}
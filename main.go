@@ -2,150 +2,1291 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-
 	"github.com/stenstromen/outlinewikibackup/api"
+	"github.com/stenstromen/outlinewikibackup/archive"
+	"github.com/stenstromen/outlinewikibackup/config"
+	"github.com/stenstromen/outlinewikibackup/encryption"
 	"github.com/stenstromen/outlinewikibackup/file"
-	"github.com/stenstromen/outlinewikibackup/s3api"
-
-	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	"github.com/stenstromen/outlinewikibackup/notify"
+	"github.com/stenstromen/outlinewikibackup/schedule"
+	"github.com/stenstromen/outlinewikibackup/secrets"
+	"github.com/stenstromen/outlinewikibackup/storage"
+	"github.com/stenstromen/outlinewikibackup/types"
 )
 
-// Custom endpoint resolver for Garage
-type garageEndpointResolver struct {
-	endpoint string
-}
-
-func (r *garageEndpointResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
-	u, err := url.Parse(r.endpoint)
-	if err != nil {
-		return smithyendpoints.Endpoint{}, err
-	}
-	return smithyendpoints.Endpoint{URI: *u}, nil
-}
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 func init() {
 	// Enable container-aware GOMAXPROCS for better performance in containers
 	// This will automatically adjust based on cgroup CPU limits
 	runtime.SetDefaultGOMAXPROCS()
+}
+
+// Process exit codes, so that schedulers such as a Kubernetes CronJob can
+// tell failed runs apart.
+const (
+	exitOK          = 0
+	exitConfig      = 2
+	exitAPI         = 3
+	exitDownload    = 4
+	exitUpload      = 5
+	exitRetention   = 6
+	exitInterrupted = 130
+)
+
+// stepError tags an error with the exit code of the step that failed.
+type stepError struct {
+	code int
+	err  error
+}
 
+func (e *stepError) Error() string { return e.err.Error() }
+func (e *stepError) Unwrap() error { return e.err }
+
+func failed(code int, err error) error {
+	return &stepError{code: code, err: err}
+}
+
+// exitCode maps an error returned by a backup step to a process exit code.
+func exitCode(ctx context.Context, err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	var se *stepError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return 1
+}
+
+// checkConfig validates the environment before any work is done and sets up
+// the backup destinations it describes.
+func checkConfig(ctx context.Context) ([]file.Target, error) {
 	if _, exists := os.LookupEnv("API_BASE_URL"); !exists {
-		log.Fatal("API_BASE_URL environment variable is not set.")
+		return nil, errors.New("API_BASE_URL environment variable is not set")
 	}
 
 	if _, exists := os.LookupEnv("AUTH_TOKEN"); !exists {
-		log.Fatal("AUTH_TOKEN environment variable is not set.")
+		return nil, errors.New("AUTH_TOKEN environment variable is not set (or AUTH_TOKEN_FILE to read it from a file)")
+	}
+
+	if _, err := api.ParseFormats(os.Getenv("EXPORT_FORMAT")); err != nil {
+		return nil, fmt.Errorf("EXPORT_FORMAT is invalid: %w", err)
+	}
+
+	for _, key := range []string{"REUSE_EXPORT_MAX_AGE", "STALE_EXPORT_MAX_AGE"} {
+		if value := os.Getenv(key); value != "" {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s is invalid: %q (expected a positive duration such as 6h)", key, value)
+			}
+		}
+	}
+
+	switch mode := os.Getenv("EXPORT_MODE"); mode {
+	case "", exportModeAll, exportModeCollections:
+	default:
+		return nil, fmt.Errorf("EXPORT_MODE is invalid: %q (expected %q or %q)", mode, exportModeAll, exportModeCollections)
+	}
+
+	if !streamToS3() {
+		dir := file.SaveDir()
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("unable to create save directory: %w", err)
+		}
+
+		testFile := filepath.Join(dir, "test_write")
+		if err := os.WriteFile(testFile, []byte("test"), 0600); err != nil {
+			return nil, fmt.Errorf("save directory is not writable: %w", err)
+		}
+		os.Remove(testFile)
+	}
+
+	if _, err := newAPIClient(); err != nil {
+		return nil, fmt.Errorf("invalid Outline API configuration: %w", err)
+	}
+
+	if _, err := encryption.FromEnv(); err != nil {
+		return nil, fmt.Errorf("invalid encryption configuration: %w", err)
 	}
 
-	saveDir := os.Getenv("SAVE_DIR")
-	if saveDir == "" {
-		saveDir = "/tmp/outlinewikibackups"
+	if _, err := notify.FromEnv(); err != nil {
+		return nil, fmt.Errorf("invalid notification configuration: %w", err)
 	}
 
-	if err := os.MkdirAll(saveDir, os.ModePerm); err != nil {
-		log.Fatal("Unable to create save directory:", err)
+	if spec := os.Getenv("SCHEDULE"); spec != "" {
+		if _, err := schedule.Parse(spec); err != nil {
+			return nil, fmt.Errorf("SCHEDULE is invalid: %w", err)
+		}
 	}
 
-	testFile := filepath.Join(saveDir, "test_write")
-	if err := os.WriteFile(testFile, []byte("test"), 0600); err != nil {
-		log.Fatal("Save directory is not writable:", err)
+	targets, err := file.NewTargets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up backup destinations: %w", err)
 	}
-	os.Remove(testFile)
+	if streamToS3() {
+		if _, local := targets[0].Destination.(*storage.Local); len(targets) != 1 || local {
+			return nil, errors.New("STREAM_TO_S3 requires exactly one S3 destination")
+		}
+	}
+
+	return targets, nil
+}
 
+// checkConnectivity makes sure Outline can be reached before an export is
+// started.
+func checkConnectivity() error {
 	// Check if API endpoint is reachable
 	apiBaseURL := os.Getenv("API_BASE_URL")
 	client := &http.Client{Timeout: 5 * time.Second}
-	_, err := client.Get(apiBaseURL)
+	resp, err := client.Get(apiBaseURL)
 	if err != nil {
-		log.Fatal("API endpoint is not reachable:", err)
+		return failed(exitAPI, fmt.Errorf("API endpoint is not reachable: %w", err))
 	}
+	resp.Body.Close()
 
-	// Check S3/MinIO connectivity if UPLOAD_TO_S3 is enabled
-	if os.Getenv("UPLOAD_TO_S3") == "true" {
-		// Skip ListBuckets check if MINIMAL_S3_PERMISSIONS is set to "true"
-		cfg := s3api.GetConfig()
-		if os.Getenv("MINIMAL_S3_PERMISSIONS") != "true" {
-			// Try to list buckets to verify connectivity
-			s3Client := s3.NewFromConfig(cfg)
-			_, err = s3Client.ListBuckets(context.Background(), &s3.ListBucketsInput{})
-			if err != nil {
-				log.Fatal("S3/MinIO is not reachable:", err)
-			}
-		} else {
-			log.Println("S3/MinIO connectivity check disabled via MINIMAL_S3_PERMISSIONS")
+	return nil
+}
+
+// probeTargets makes sure the targets can be reached and logs what each
+// bucket's credentials allow. Only bucket-level permissions are needed, so a
+// key scoped to one bucket works.
+func probeTargets(ctx context.Context, targets []file.Target) error {
+	for _, target := range targets {
+		prober, ok := target.Destination.(storage.Prober)
+		if !ok {
+			continue
+		}
+		caps, err := prober.Probe(ctx)
+		if err != nil {
+			return failed(exitUpload, fmt.Errorf("destination %s (%s) is not usable: %w", target.Name, target.Destination, err))
+		}
+		log.Printf("Destination %s (%s): %s", target.Name, target.Destination, caps)
+		if !caps.Read {
+			log.Printf("Destination %s: uploaded archives can't be checked", target.Name)
+		}
+		if !caps.List {
+			log.Printf("Destination %s: keeping track of backups in %s", target.Name, storage.IndexKey)
+		}
+		if !target.Retention.IsZero() && !caps.Delete {
+			log.Printf("Destination %s: old backups can't be removed", target.Name)
 		}
 	}
+
+	return nil
 }
 
+const (
+	exportModeAll         = "all"
+	exportModeCollections = "collections"
+)
+
+// cleanupTimeout bounds the server-side cleanup that still runs after a
+// failed step or after the main context has been cancelled by a signal.
+const cleanupTimeout = 30 * time.Second
+
+var (
+	configPath  = flag.String("config", os.Getenv("CONFIG_FILE"), "read settings from this YAML file; environment variables override it")
+	dryRun      = flag.Bool("dry-run", false, "only log which backups the retention policy would keep and delete")
+	decryptPath = flag.String("decrypt", "", "decrypt the encrypted archive at this path next to it, verify it and exit")
+	verifyPath  = flag.String("verify", "", "verify the archive at this path, decrypting it in memory if it is encrypted, and exit")
+)
+
 func main() {
+	log.SetOutput(secrets.NewWriter(os.Stderr))
+
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(command(flag.Args()))
+	}
+
+	// Restores only need the keys, which they check themselves, so the
+	// environment alone isn't held to what a backup requires
+	restoring := *decryptPath != "" || *verifyPath != ""
+	if *configPath != "" || !restoring {
+		if err := loadConfig(*configPath); err != nil {
+			log.Println("Configuration error:", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if err := secrets.Load(); err != nil {
+		log.Println("Configuration error:", err)
+		os.Exit(exitConfig)
+	}
+
+	switch {
+	case *decryptPath != "":
+		os.Exit(decryptArchive(*decryptPath))
+	case *verifyPath != "":
+		os.Exit(verifyArchive(*verifyPath))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if spec := os.Getenv("SCHEDULE"); spec != "" && !*dryRun {
+		os.Exit(daemon(ctx, spec))
+	}
+	os.Exit(runAndNotify(ctx))
+}
+
+// command runs a subcommand. The only one is "config validate".
+func command(args []string) int {
+	if len(args) < 2 || args[0] != "config" || args[1] != "validate" {
+		log.Printf("Unknown command %q (expected \"config validate\")", strings.Join(args, " "))
+		return exitConfig
+	}
+
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	path := flags.String("config", *configPath, "the YAML file to validate")
+	if err := flags.Parse(args[2:]); err != nil {
+		return exitConfig
+	}
+	return validateConfig(*path)
+}
+
+// loadConfig reads the configuration file at path, or only the environment if
+// path is empty, validates it and exports the result to the environment.
+func loadConfig(path string) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Apply(); err != nil {
+		return err
+	}
+	if path != "" {
+		log.Println("Loaded configuration from", path)
+	}
+	return nil
+}
+
+// validateConfig checks the configuration file at path, or the environment
+// alone if path is empty, as a run would, and prints the effective
+// configuration with its secrets masked.
+func validateConfig(path string) int {
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = cfg.Apply()
+	}
+	if err == nil {
+		err = secrets.Load()
+	}
+	if err == nil {
+		_, err = checkConfig(context.Background())
+	}
+	if err != nil {
+		log.Println("Configuration error:", err)
+		return exitConfig
+	}
+
+	if err := cfg.Redacted().Write(os.Stdout); err != nil {
+		log.Println("Error printing configuration:", err)
+		return exitConfig
+	}
+	log.Println("Configuration is valid")
+	return exitOK
+}
+
+// daemon runs a backup whenever spec is due, until ctx is cancelled. Failed
+// runs are reported but don't stop the daemon.
+func daemon(ctx context.Context, spec string) int {
+	sched, err := schedule.Parse(spec)
+	if err != nil {
+		log.Println("Configuration error: SCHEDULE is invalid:", err)
+		return exitConfig
+	}
+	log.Println("Running backups on schedule", sched.String())
+
+	for {
+		next := sched.Next(time.Now())
+		log.Println("Next backup at", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Println("Stopping")
+			return exitOK
+		case <-timer.C:
+		}
+
+		if code := runAndNotify(ctx); code == exitInterrupted {
+			return code
+		}
+	}
+}
+
+// runAndNotify runs a backup and sends its outcome to the notification
+// webhook, if there is one.
+func runAndNotify(ctx context.Context) int {
+	started := time.Now()
+	archives, err := run(ctx)
+	code := exitCode(ctx, err)
+
+	webhook, whErr := notify.FromEnv()
+	if whErr != nil || webhook == nil {
+		return code
+	}
+
+	instance := os.Getenv("API_BASE_URL")
+	if u, err := url.Parse(instance); err == nil && u.Host != "" {
+		instance = u.Hostname()
+	}
+	event := notify.Event{
+		Success:    code == exitOK,
+		ExitCode:   code,
+		Instance:   instance,
+		StartedAt:  started,
+		FinishedAt: time.Now(),
+	}
+	documents := 0
+	for _, a := range archives {
+		event.Archives = append(event.Archives, notify.Archive{
+			Name:      filepath.Base(a.Path),
+			Documents: a.Documents,
+			Size:      a.Size,
+			SHA256:    a.SHA256,
+		})
+		documents += a.Documents
+	}
+	if event.Success {
+		noun := "archives"
+		if len(archives) == 1 {
+			noun = "archive"
+		}
+		event.Text = fmt.Sprintf("Outline backup of %s succeeded: %d %s, %d documents", instance, len(archives), noun, documents)
+	} else {
+		event.Error = secrets.Redact(err.Error())
+		event.Text = fmt.Sprintf("Outline backup of %s failed (exit code %d): %s", instance, code, event.Error)
+	}
+
+	// Send the outcome even if the run was cancelled by a signal
+	sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	if err := webhook.Send(sendCtx, event); err != nil {
+		log.Println("Error sending notification:", err)
+	}
+	return code
+}
+
+// run performs a single backup and returns the archives it stored. Its
+// error carries the exit code of the step that failed.
+func run(ctx context.Context) ([]types.ArchiveSummary, error) {
 	log.Println("Starting Outline Wiki Backup...")
 
-	exportID, err := api.InitiateExport()
+	// Secrets are read again for every run, so that a daemon picks up
+	// rotated ones
+	if err := secrets.Load(); err != nil {
+		log.Println("Configuration error:", err)
+		return nil, failed(exitConfig, err)
+	}
+	targets, err := checkConfig(ctx)
 	if err != nil {
-		log.Println("Error initiating export:", err)
-		return
+		log.Println("Configuration error:", err)
+		return nil, failed(exitConfig, err)
+	}
+
+	if *dryRun {
+		return nil, dryRunRetention(ctx, targets)
 	}
-	log.Println("Export initiated, ID:", exportID)
 
-	log.Println("Checking export progress...")
-	err = api.WaitForExportCompletion(exportID)
+	enc, err := encryption.FromEnv()
 	if err != nil {
-		log.Println("Error checking export progress:", err)
-		return
+		log.Println("Error setting up encryption:", err)
+		return nil, failed(exitConfig, err)
+	}
+	if enc != nil {
+		log.Println("Encrypting archives with", enc.String())
 	}
-	log.Println("Export completed!")
 
-	log.Println("Fetching download link and saving file...")
-	filename, err := api.FetchAndSaveExport(exportID)
+	if err := checkConnectivity(); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err := probeTargets(ctx, targets); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	formats, err := api.ParseFormats(os.Getenv("EXPORT_FORMAT"))
 	if err != nil {
-		log.Println("Error fetching and saving export:", err)
-		return
+		log.Println("Error parsing export formats:", err)
+		return nil, failed(exitConfig, err)
+	}
+
+	client, err := newAPIClient()
+	if err != nil {
+		log.Println("Error creating Outline API client:", err)
+		return nil, failed(exitConfig, err)
 	}
-	log.Println("File downloaded successfully:", filename)
 
-	uploadToS3Flag := os.Getenv("UPLOAD_TO_S3")
-	if uploadToS3Flag == "true" {
-		log.Println("Uploading file to S3/MinIO...")
-		err = file.UploadToS3(filename)
+	// A nil collection stands for a single export of the whole workspace.
+	collections := []*types.Collection{nil}
+	if os.Getenv("EXPORT_MODE") == exportModeCollections {
+		collections, err = selectCollections(ctx, client)
 		if err != nil {
-			log.Println("Error uploading file to S3/MinIO:", err)
-			return
+			log.Println("Error listing collections:", err)
+			return nil, failed(exitAPI, err)
 		}
-		log.Println("File uploaded successfully to S3/MinIO")
-		if err := os.Remove(filename); err != nil {
-			log.Println("Error deleting file:", err)
-			return
+	}
+
+	reusable := reconcileExports(ctx, client)
+
+	var archives []types.ArchiveSummary
+	for _, format := range formats {
+		for _, collection := range collections {
+			reuse := takeReusable(&reusable, format, collection)
+			summary, err := backupExport(ctx, client, targets, enc, format, collection, reuse)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Println("Backup interrupted")
+				}
+				return archives, err
+			}
+			archives = append(archives, summary)
 		}
-		log.Println("Local file deleted successfully")
 	}
 
-	log.Println("Deleting export from server...")
-	err = api.DeleteExport(exportID)
+	if err := applyRetention(ctx, targets, client.ArchivePattern(), false); err != nil {
+		return archives, err
+	}
+
+	log.Println("Backup completed successfully!")
+	return archives, nil
+}
+
+// selectCollections lists the workspace collections and applies the
+// COLLECTIONS_INCLUDE and COLLECTIONS_EXCLUDE filters.
+func selectCollections(ctx context.Context, client *api.Client) ([]*types.Collection, error) {
+	log.Println("Listing collections...")
+	all, err := client.ListCollections(ctx)
 	if err != nil {
-		log.Println("Error deleting export:", err)
-		return
+		return nil, err
 	}
-	log.Println("Export deleted successfully!")
 
-	keepBackups := os.Getenv("KEEP_BACKUPS")
-	if keepBackups != "" {
-		log.Println("Keeping only", keepBackups, "backups")
-		err = file.KeepOnlyNBackups(keepBackups)
+	filtered := api.FilterCollections(all, splitList(os.Getenv("COLLECTIONS_INCLUDE")), splitList(os.Getenv("COLLECTIONS_EXCLUDE")))
+	log.Printf("Exporting %d of %d collections", len(filtered), len(all))
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no collections left to export after applying filters")
+	}
+
+	collections := make([]*types.Collection, len(filtered))
+	for i := range filtered {
+		collections[i] = &filtered[i]
+	}
+	return collections, nil
+}
+
+// reconcileExports looks at the exports earlier runs left on the server.
+// Only exports recorded in SAVE_DIR as started by this tool are considered,
+// never those made by hand or by other tools. Those older than
+// STALE_EXPORT_MAX_AGE are deleted, and completed ones younger than
+// REUSE_EXPORT_MAX_AGE are returned so they can be downloaded instead of
+// starting a new export. Failures are logged and otherwise ignored.
+func reconcileExports(ctx context.Context, client *api.Client) []types.FileOperation {
+	reuseAge := envDuration("REUSE_EXPORT_MAX_AGE")
+	staleAge := envDuration("STALE_EXPORT_MAX_AGE")
+	if reuseAge == 0 && staleAge == 0 {
+		return nil
+	}
+
+	started, err := file.StartedExports()
+	if err != nil {
+		log.Println("Error reading the exports of earlier runs, skipping export cleanup:", err)
+		return nil
+	}
+	if len(started) == 0 {
+		return nil
+	}
+
+	log.Println("Checking for exports left on the server...")
+	userID, err := client.CurrentUserID(ctx)
+	if err != nil {
+		log.Println("Error looking up API key user, skipping export cleanup:", err)
+		return nil
+	}
+
+	exports, err := client.ListExports(ctx)
+	if err != nil {
+		log.Println("Error listing exports, skipping export cleanup:", err)
+		return nil
+	}
+
+	// Exports deleted by other means are no longer tracked
+	gone := maps.Clone(started)
+	var reusable []types.FileOperation
+	for _, op := range exports {
+		delete(gone, op.ID)
+		if op.User.ID != userID || !started[op.ID] {
+			continue
+		}
+
+		age := time.Since(op.CreatedAt)
+		switch {
+		case staleAge > 0 && age > staleAge:
+			log.Printf("Deleting stale export %s (%s, created %s ago)", op.ID, op.State, age.Round(time.Second))
+			if err := client.DeleteExport(ctx, op.ID); err != nil {
+				log.Println("Error deleting stale export:", err)
+			} else {
+				gone[op.ID] = true
+			}
+		case reuseAge > 0 && age <= reuseAge && op.State == api.StateComplete:
+			reusable = append(reusable, op)
+		}
+	}
+
+	if len(gone) > 0 {
+		if err := file.ForgetExports(slices.Collect(maps.Keys(gone))...); err != nil {
+			log.Println("Error updating the exports of earlier runs:", err)
+		}
+	}
+
+	log.Println("Found", len(reusable), "reusable exports")
+	return reusable
+}
+
+// takeReusable removes and returns the newest export in reusable that
+// matches format and collection, or nil if there is none.
+func takeReusable(reusable *[]types.FileOperation, format string, collection *types.Collection) *types.FileOperation {
+	collectionID := ""
+	if collection != nil {
+		collectionID = collection.ID
+	}
+
+	best := -1
+	for i, op := range *reusable {
+		if op.Format != format || op.CollectionID != collectionID {
+			continue
+		}
+		if best < 0 || op.CreatedAt.After((*reusable)[best].CreatedAt) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	op := (*reusable)[best]
+	*reusable = append((*reusable)[:best], (*reusable)[best+1:]...)
+	return &op
+}
+
+// backupExport runs a single export of the given format from initiation to
+// server-side deletion, storing the archive in every target, encrypted by
+// enc unless it is nil. A nil collection exports the whole workspace. When
+// reuse is set, that completed export is downloaded instead of starting a
+// new one. Errors are logged and tagged with an exit code before being
+// returned. Once the export exists on the server it is deleted again even if
+// a later step fails or ctx is cancelled.
+func backupExport(ctx context.Context, client *api.Client, targets []file.Target, enc encryption.Encrypter, format string, collection *types.Collection, reuse *types.FileOperation) (summary types.ArchiveSummary, err error) {
+	var exportID string
+	if reuse != nil {
+		log.Printf("Reusing %s export %s created at %s", api.FormatLabel(format), reuse.ID, reuse.CreatedAt.Format(time.RFC3339))
+		exportID = reuse.ID
+	} else if collection == nil {
+		log.Println("Initiating", api.FormatLabel(format), "export...")
+		exportID, err = client.InitiateExport(ctx, format)
+	} else {
+		log.Println("Initiating", api.FormatLabel(format), "export of collection", collection.Name+"...")
+		exportID, err = client.InitiateCollectionExport(ctx, collection.ID, format)
+	}
+	if err != nil {
+		log.Println("Error initiating export:", err)
+		return summary, failed(exitAPI, err)
+	}
+	if reuse == nil {
+		log.Println("Export initiated, ID:", exportID)
+		if err := file.RecordExport(exportID); err != nil {
+			log.Println("Error recording export, later runs won't reuse or delete it:", err)
+		}
+	}
+
+	defer func() {
+		// Use a fresh context so the export is removed even after a signal
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+
 		if err != nil {
-			log.Println("Error keeping only", keepBackups, "backups:", err)
+			log.Println("Backup failed, deleting export", exportID, "from server...")
+		} else {
+			log.Println("Deleting export from server...")
+		}
+		if deleteErr := client.DeleteExport(cleanupCtx, exportID); deleteErr != nil {
+			log.Println("Error deleting export:", deleteErr)
+			if err == nil {
+				err = failed(exitAPI, deleteErr)
+			}
 			return
 		}
+		log.Println("Export deleted successfully!")
+		if err := file.ForgetExports(exportID); err != nil {
+			log.Println("Error updating the recorded exports:", err)
+		}
+	}()
+
+	if reuse == nil {
+		log.Println("Checking export progress...")
+		err = client.WaitForExportCompletion(ctx, exportID)
+		if err != nil {
+			log.Println("Error checking export progress:", err)
+			return summary, failed(exitAPI, err)
+		}
+		log.Println("Export completed!")
+	}
+
+	meta := archiveMetadata(client, format, exportID)
+	key := client.ArchiveName(format, collection)
+	if enc != nil {
+		if streamToS3() {
+			dest := targets[0].Destination
+			err = retryCorrupt(func() (err error) {
+				summary, err = sealExport(ctx, client, enc, dest, exportID, key, meta)
+				return err
+			})
+			if err != nil {
+				return summary, err
+			}
+			return summary, storeChecksum(ctx, dest, summary.Path, summary.SHA256)
+		}
+		summary, err = sealExport(ctx, client, enc, storage.NewLocal(file.SaveDir()), exportID, key, nil)
+		if err != nil {
+			return summary, err
+		}
+		summary.Path = filepath.Join(file.SaveDir(), summary.Path)
+		return summary, storeArchive(ctx, targets, summary, describeArchive(meta, summary))
+	}
+
+	if streamToS3() {
+		dest := targets[0].Destination
+		err = retryCorrupt(func() (err error) {
+			summary, err = streamExport(ctx, client, dest, exportID, key, meta)
+			return err
+		})
+		if err != nil {
+			return summary, err
+		}
+		return summary, storeChecksum(ctx, dest, key, summary.SHA256)
+	}
+
+	log.Println("Fetching download link and saving file...")
+	saved, err := client.FetchAndSaveExport(ctx, exportID, file.SaveDir(), key)
+	if err != nil {
+		log.Println("Error fetching and saving export:", err)
+		return summary, failed(exitDownload, err)
+	}
+	filename := saved.Path
+	log.Println("File downloaded successfully:", filename)
+
+	log.Println("Verifying archive...")
+	summary, err = archive.Verify(ctx, filename)
+	if err = allowEmpty(filename, err); err != nil {
+		log.Println("Error verifying archive:", err)
+		if rmErr := os.Remove(filename); rmErr != nil {
+			log.Println("Error deleting unverified file:", rmErr)
+		}
+		return summary, failed(exitDownload, err)
+	}
+	log.Printf("Archive verified: %d documents, %d attachments, %d entries, %d bytes",
+		summary.Documents, summary.Attachments, summary.Entries, summary.Size)
+	summary.SHA256, summary.MD5 = saved.SHA256, saved.MD5
+
+	return summary, storeArchive(ctx, targets, summary, describeArchive(meta, summary))
+}
+
+// archiveMetadata describes the archive of an export in the metadata of
+// stored objects.
+func archiveMetadata(client *api.Client, format, exportID string) storage.Metadata {
+	return storage.Metadata{
+		"outline-host":      client.Hostname(),
+		"export-format":     api.FormatLabel(format),
+		"file-operation-id": exportID,
+		"tool-version":      version,
+	}
+}
+
+// describeArchive adds the hash and document count of a verified archive to
+// meta.
+func describeArchive(meta storage.Metadata, summary types.ArchiveSummary) storage.Metadata {
+	meta = maps.Clone(meta)
+	meta[storage.MetaSHA256] = summary.SHA256
+	meta["documents"] = strconv.Itoa(summary.Documents)
+	return meta
+}
+
+// checkSidecar compares the archive at path with the SHA-256 in its checksum
+// sidecar, if there is one.
+func checkSidecar(path string) error {
+	want, err := file.ReadChecksum(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	got, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %q has SHA-256 %s, but its checksum file says %s", storage.ErrChecksum, path, got, want)
+	}
+	log.Println("Checksum matches", path+file.ChecksumSuffix)
+	return nil
+}
+
+// hashFile returns the hex encoded SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// storeArchive copies a verified archive to all targets in parallel, checks
+// that it arrived whole, writes its checksum sidecar next to it and then
+// removes the local copy. Archives downloaded straight into a local
+// destination are already in place and kept. Every target is tried, and the
+// run fails if any of them failed. meta is stored with every copy.
+func storeArchive(ctx context.Context, targets []file.Target, summary types.ArchiveSummary, meta storage.Metadata) error {
+	key := filepath.Base(summary.Path)
+	inPlace := false
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		local, ok := target.Destination.(*storage.Local)
+		here := ok && local.Dir == filepath.Dir(summary.Path)
+		inPlace = inPlace || here
+		wg.Go(func() {
+			if !here {
+				err := retryCorrupt(func() error {
+					return putArchive(ctx, target.Destination, key, summary, meta)
+				})
+				if err != nil {
+					errs[i] = err
+					return
+				}
+			}
+			errs[i] = file.WriteChecksum(ctx, target.Destination, key, summary.SHA256)
+		})
+	}
+	wg.Wait()
+
+	var failures []error
+	for i, target := range targets {
+		if errs[i] != nil {
+			log.Printf("Destination %s (%s): failed: %v", target.Name, target.Destination, errs[i])
+			failures = append(failures, fmt.Errorf("destination %s: %w", target.Name, errs[i]))
+			continue
+		}
+		log.Printf("Destination %s (%s): stored %s", target.Name, target.Destination, key)
+	}
+	if len(failures) > 0 {
+		return failed(exitUpload, errors.Join(failures...))
+	}
+
+	if inPlace {
+		return nil
+	}
+	if err := os.Remove(summary.Path); err != nil {
+		log.Println("Error deleting file:", err)
+		return failed(exitUpload, err)
+	}
+	log.Println("Local file deleted successfully")
+	return nil
+}
+
+// putArchive uploads the archive described by summary to dest as key.
+func putArchive(ctx context.Context, dest storage.Destination, key string, summary types.ArchiveSummary, meta storage.Metadata) error {
+	log.Println("Uploading file to", dest.String()+"...")
+	f, err := os.Open(summary.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := dest.Put(ctx, key, f, meta); err != nil {
+		return err
+	}
+	return checkStored(ctx, dest, key, storage.Checksums{Size: summary.Size, SHA256: summary.SHA256, MD5: summary.MD5})
+}
+
+// storeAttempts is how often an archive that arrives corrupted is uploaded
+// before giving up.
+const storeAttempts = 3
+
+// retryCorrupt calls store until it succeeds, fails with an error other than
+// storage.ErrChecksum, or storeAttempts are used up.
+func retryCorrupt(store func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := store()
+		if !errors.Is(err, storage.ErrChecksum) || attempt == storeAttempts {
+			return err
+		}
+		log.Printf("Upload arrived corrupted (attempt %d/%d), uploading again: %v", attempt, storeAttempts, err)
+	}
+}
+
+// storeChecksum writes the checksum sidecar of an archive streamed into
+// dest.
+func storeChecksum(ctx context.Context, dest storage.Destination, key, sum string) error {
+	if err := file.WriteChecksum(ctx, dest, key, sum); err != nil {
+		log.Println("Error storing checksum:", err)
+		return failed(exitUpload, err)
+	}
+	return nil
+}
+
+// applyRetention deletes the archives matching pattern that the retention
+// policy of each target doesn't keep. Every target is tried, and the run
+// fails if any of them failed. With dryRun set, the decisions are only
+// logged.
+func applyRetention(ctx context.Context, targets []file.Target, pattern *regexp.Regexp, dryRun bool) error {
+	var failures []error
+	for _, target := range targets {
+		if target.Retention.IsZero() {
+			log.Printf("Destination %s: keeping all backups", target.Name)
+			continue
+		}
+
+		log.Printf("Destination %s: applying retention policy: %s", target.Name, target.Retention)
+		if err := file.PruneBackups(ctx, target.Destination, target.Retention, pattern, dryRun); err != nil {
+			log.Printf("Destination %s: error applying retention policy: %v", target.Name, err)
+			failures = append(failures, fmt.Errorf("destination %s: %w", target.Name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return failed(exitRetention, errors.Join(failures...))
+	}
+	return nil
+}
+
+// dryRunRetention logs which backups the retention policies would keep and
+// delete, without exporting or deleting anything.
+func dryRunRetention(ctx context.Context, targets []file.Target) error {
+	log.Println("Dry run: evaluating retention policies only")
+
+	if err := probeTargets(ctx, targets); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	client, err := newAPIClient()
+	if err != nil {
+		log.Println("Error creating Outline API client:", err)
+		return failed(exitConfig, err)
+	}
+
+	return applyRetention(ctx, targets, client.ArchivePattern(), true)
+}
+
+// checkStored makes sure the object stored as key has the expected size and
+// the hashes dest knows of it, unless dest can't describe its objects. A
+// corrupt object is deleted again and reported with storage.ErrChecksum.
+func checkStored(ctx context.Context, dest storage.Destination, key string, want storage.Checksums) error {
+	obj, err := dest.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotSupported) {
+		log.Println("Skipping check of uploaded file:", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to check uploaded file: %w", err)
+	}
+	if err := want.Check(obj); err != nil {
+		if delErr := dest.Delete(ctx, key); delErr != nil {
+			log.Println("Error deleting corrupt upload:", delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// streamExport pipes the archive of a completed export straight into a
+// multipart upload, hashing it on the way. The archive is never written to
+// disk; it is verified as it streams past, and a stored archive that fails
+// verification is deleted again. The upload starts before the archive's
+// hash and document count are known, so meta lacks them. The returned
+// summary has key as its Path and the stored size and hashes.
+func streamExport(ctx context.Context, client *api.Client, dest storage.Destination, exportID, key string, meta storage.Metadata) (types.ArchiveSummary, error) {
+	log.Println("Streaming export to", dest.String(), "as", key+"...")
+	r, err := client.OpenExport(ctx, exportID)
+	if err != nil {
+		log.Println("Error opening export download:", err)
+		return types.ArchiveSummary{}, failed(exitDownload, err)
+	}
+	defer r.Close()
+
+	if r.Size() == 0 {
+		log.Println("Export archive is empty")
+		return types.ArchiveSummary{}, failed(exitDownload, errors.New("export archive is empty"))
+	}
+
+	type result struct {
+		summary types.ArchiveSummary
+		err     error
+	}
+	plain, plainWriter := io.Pipe()
+	verified := make(chan result, 1)
+	go func() {
+		summary, err := archive.VerifyStream(ctx, plain, key)
+		err = allowEmpty(key, err)
+		// Stops the upload if verification fails
+		plain.CloseWithError(err)
+		verified <- result{summary, err}
+	}()
+
+	source := &readErrRecorder{r: r}
+	hash, sum := sha256.New(), md5.New()
+	putErr := dest.Put(ctx, key, io.TeeReader(io.TeeReader(source, plainWriter), io.MultiWriter(hash, sum)), meta)
+	plainWriter.CloseWithError(putErr)
+	v := <-verified
+
+	switch {
+	case source.err != nil:
+		log.Println("Error downloading export:", source.err)
+		return types.ArchiveSummary{}, failed(exitDownload, source.err)
+	case v.err != nil && (putErr == nil || !errors.Is(v.err, putErr)):
+		log.Println("Error verifying archive:", v.err)
+		if putErr == nil {
+			if err := dest.Delete(ctx, key); err != nil {
+				log.Println("Error deleting unverified archive:", err)
+			}
+		}
+		return types.ArchiveSummary{}, failed(exitDownload, v.err)
+	case putErr != nil:
+		log.Println("Error streaming export:", putErr)
+		return types.ArchiveSummary{}, failed(exitUpload, putErr)
+	}
+	log.Printf("Archive verified: %d documents, %d attachments, %d entries, %d bytes",
+		v.summary.Documents, v.summary.Attachments, v.summary.Entries, v.summary.Size)
+
+	summary := v.summary
+	summary.Path = key
+	summary.Size = r.Offset()
+	summary.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	summary.MD5 = hex.EncodeToString(sum.Sum(nil))
+	if err := checkStored(ctx, dest, key, storage.Checksums{Size: summary.Size, SHA256: summary.SHA256, MD5: summary.MD5}); err != nil {
+		log.Println("Error streaming export:", err)
+		return types.ArchiveSummary{}, failed(exitUpload, err)
+	}
+
+	log.Printf("Export streamed successfully: %d bytes, SHA-256 %s", summary.Size, summary.SHA256)
+	return summary, nil
+}
+
+// sealExport downloads the archive of a completed export and stores it in
+// dest encrypted by enc, as key with the encryption suffix. The plaintext
+// never touches the disk; it is verified on its way into the encryption, and
+// a stored archive that fails verification is deleted again. The returned
+// summary has the stored key as its Path and the encrypted size and hash.
+// meta is stored with the archive.
+func sealExport(ctx context.Context, client *api.Client, enc encryption.Encrypter, dest storage.Destination, exportID, key string, meta storage.Metadata) (types.ArchiveSummary, error) {
+	key += enc.Suffix()
+	log.Println("Encrypting export into", dest.String(), "as", key+"...")
+	// The download is cancelled when the upload fails, since the
+	// encryption may be waiting on it
+	downloadCtx, cancelDownload := context.WithCancel(ctx)
+	defer cancelDownload()
+	r, err := client.OpenExport(downloadCtx, exportID)
+	if err != nil {
+		log.Println("Error opening export download:", err)
+		return types.ArchiveSummary{}, failed(exitDownload, err)
+	}
+	defer r.Close()
+
+	if r.Size() == 0 {
+		log.Println("Export archive is empty")
+		return types.ArchiveSummary{}, failed(exitDownload, errors.New("export archive is empty"))
+	}
+
+	type result struct {
+		summary types.ArchiveSummary
+		err     error
+	}
+	plain, plainWriter := io.Pipe()
+	verified := make(chan result, 1)
+	go func() {
+		summary, err := archive.VerifyStream(ctx, plain, key)
+		err = allowEmpty(key, err)
+		// Stops the encryption, and with it the upload, if verification fails
+		plain.CloseWithError(err)
+		verified <- result{summary, err}
+	}()
+
+	source := &readErrRecorder{r: r}
+	sealed := encryption.Reader(enc, io.TeeReader(source, plainWriter))
+	hash, sum := sha256.New(), md5.New()
+	var stored byteCounter
+	putErr := dest.Put(ctx, key, io.TeeReader(sealed, io.MultiWriter(hash, sum, &stored)), meta)
+	if putErr != nil {
+		cancelDownload()
+	}
+	// Waits for the encryption, which reads r and sets source.err
+	sealed.Close()
+	plainWriter.CloseWithError(putErr)
+	v := <-verified
+
+	downloadErr := source.err
+	if putErr != nil && ctx.Err() == nil && errors.Is(downloadErr, context.Canceled) {
+		// Cancelled above, so the upload is to blame
+		downloadErr = nil
+	}
+
+	switch {
+	case downloadErr != nil:
+		log.Println("Error downloading export:", downloadErr)
+		return v.summary, failed(exitDownload, downloadErr)
+	case v.err != nil && (putErr == nil || !errors.Is(v.err, putErr)):
+		log.Println("Error verifying archive:", v.err)
+		if putErr == nil {
+			if err := dest.Delete(ctx, key); err != nil {
+				log.Println("Error deleting unverified archive:", err)
+			}
+		}
+		return v.summary, failed(exitDownload, v.err)
+	case putErr != nil:
+		log.Println("Error storing encrypted export:", putErr)
+		return v.summary, failed(exitUpload, putErr)
+	}
+	log.Printf("Archive verified: %d documents, %d attachments, %d entries, %d bytes",
+		v.summary.Documents, v.summary.Attachments, v.summary.Entries, v.summary.Size)
+
+	summary := v.summary
+	summary.Path = key
+	summary.Size = int64(stored)
+	summary.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	summary.MD5 = hex.EncodeToString(sum.Sum(nil))
+	if err := checkStored(ctx, dest, key, storage.Checksums{Size: summary.Size, SHA256: summary.SHA256, MD5: summary.MD5}); err != nil {
+		log.Println("Error storing encrypted export:", err)
+		return v.summary, failed(exitUpload, err)
+	}
+
+	log.Printf("Export encrypted successfully: %d bytes, SHA-256 %s", stored, summary.SHA256)
+	return summary, nil
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// decryptArchive restores the plaintext of the encrypted archive at path
+// next to it and verifies it. The plaintext is only kept if it is complete
+// and verified.
+func decryptArchive(path string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !encryption.IsEncrypted(path) {
+		log.Printf("%s is not an encrypted archive (expected a %s or %s suffix)", path, encryption.SuffixAge, encryption.SuffixPGP)
+		return exitConfig
+	}
+	decrypter, err := encryption.DecrypterFromEnv()
+	if err != nil {
+		log.Println("Configuration error:", err)
+		return exitConfig
+	}
+
+	dir, name := filepath.Split(path)
+	name = encryption.TrimSuffix(name)
+	output := filepath.Join(dir, name)
+	if _, err := os.Stat(output); err == nil {
+		log.Println("Not overwriting existing file", output)
+		return exitConfig
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println("Error opening archive:", err)
+		return 1
+	}
+	defer f.Close()
+
+	plain, err := decrypter.Decrypt(path, f)
+	if err != nil {
+		log.Println("Error decrypting archive:", err)
+		return 1
+	}
+	// Put keeps nothing unless the ciphertext decrypted and authenticated
+	// to the end
+	if err := storage.NewLocal(dir).Put(ctx, name, plain, nil); err != nil {
+		log.Println("Error decrypting archive:", err)
+		return exitCode(ctx, err)
+	}
+
+	summary, err := archive.Verify(ctx, output)
+	if err = allowEmpty(output, err); err != nil {
+		log.Println("Error verifying archive:", err)
+		if rmErr := os.Remove(output); rmErr != nil {
+			log.Println("Error deleting unverified file:", rmErr)
+		}
+		return exitCode(ctx, err)
+	}
+	log.Printf("Archive decrypted to %s and verified: %d documents, %d attachments, %d entries, %d bytes",
+		output, summary.Documents, summary.Attachments, summary.Entries, summary.Size)
+	return exitOK
+}
+
+// verifyArchive checks the archive at path, decrypting it in memory first if
+// it is encrypted.
+func verifyArchive(path string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := checkSidecar(path); err != nil {
+		log.Println("Error verifying archive:", err)
+		return exitDownload
+	}
+
+	var summary types.ArchiveSummary
+	var err error
+	if encryption.IsEncrypted(path) {
+		summary, err = verifyEncrypted(ctx, path)
 	} else {
-		log.Println("Keeping all backups")
+		summary, err = archive.Verify(ctx, path)
 	}
+	if err = allowEmpty(path, err); err != nil {
+		log.Println("Error verifying archive:", err)
+		return exitCode(ctx, err)
+	}
+	log.Printf("Archive verified: %d documents, %d attachments, %d entries, %d bytes",
+		summary.Documents, summary.Attachments, summary.Entries, summary.Size)
+	return exitOK
+}
 
-	log.Println("Backup completed successfully!")
+func verifyEncrypted(ctx context.Context, path string) (types.ArchiveSummary, error) {
+	decrypter, err := encryption.DecrypterFromEnv()
+	if err != nil {
+		return types.ArchiveSummary{}, failed(exitConfig, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return types.ArchiveSummary{}, err
+	}
+	defer f.Close()
+
+	plain, err := decrypter.Decrypt(path, f)
+	if err != nil {
+		return types.ArchiveSummary{}, fmt.Errorf("unable to decrypt %q: %w", path, err)
+	}
+	return archive.VerifyStream(ctx, plain, path)
+}
+
+// allowEmpty passes the verification of the archive name despite err if the
+// archive holds a single collection without documents, since collections
+// may well be empty. The whole workspace never is.
+func allowEmpty(name string, err error) error {
+	if errors.Is(err, archive.ErrNoDocuments) && api.IsCollectionArchive(filepath.Base(name)) {
+		log.Println("Archive", name, "contains no documents, the collection is empty")
+		return nil
+	}
+	return err
+}
+
+// readErrRecorder remembers the first non-EOF read error, so that a failed
+// download can be told apart from a failed upload.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+func streamToS3() bool {
+	return os.Getenv("STREAM_TO_S3") == "true"
+}
+
+func newAPIClient() (*api.Client, error) {
+	return api.NewClient(api.Options{
+		BaseURL:         os.Getenv("API_BASE_URL"),
+		Token:           os.Getenv("AUTH_TOKEN"),
+		UserAgent:       "outlinewikibackup/" + version,
+		RetryAttempts:   envInt("API_RETRY_ATTEMPTS"),
+		PollInterval:    time.Duration(envInt("SLEEP_DURATION")) * time.Second,
+		MaxPollInterval: time.Duration(envInt("MAX_SLEEP_DURATION")) * time.Second,
+		ExportTimeout:   time.Duration(envInt("EXPORT_TIMEOUT")) * time.Second,
+	})
+}
+
+// splitList splits a comma separated environment value into its trimmed,
+// non-empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envDuration parses a Go duration such as "6h" from the environment. It
+// returns zero when the variable is unset; checkConfig rejects invalid values.
+func envDuration(key string) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// envInt returns the integer value of an environment variable, or zero when
+// it is unset or not a number so that the api defaults apply.
+func envInt(key string) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return value
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stenstromen/outlinewikibackup/api"
+	"github.com/stenstromen/outlinewikibackup/encryption"
+	"github.com/stenstromen/outlinewikibackup/file"
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+// exportServer serves archive as the download of every export, in small
+// chunks with a pause in between so that readers are caught mid-transfer.
+func exportServer(t *testing.T, archive []byte) *api.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+		for chunk := range slices.Chunk(archive, 16<<10) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(api.Options{BaseURL: server.URL, Token: "test-token", Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// testArchive returns a valid export archive of about size bytes.
+func testArchive(t *testing.T, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("Engineering/Welcome.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(w, rand.Reader, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// failingDestination fails every upload once it has read limit bytes of
+// it. Like a multipart upload, it reads whole writes of the encryption and
+// fails in between, while the encryption waits on the download.
+type failingDestination struct {
+	storage.Destination
+	limit int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (d failingDestination) String() string { return "failing" }
+
+func (d failingDestination) Put(ctx context.Context, key string, body io.Reader, meta storage.Metadata) error {
+	buf := make([]byte, 1<<20)
+	for read := 0; read < d.limit; {
+		n, err := body.Read(buf)
+		if err != nil {
+			return err
+		}
+		read += n
+	}
+	return errDiskFull
+}
+
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestSealExportUploadFails(t *testing.T) {
+	quietLog(t)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_AGE_RECIPIENTS", identity.Recipient().String())
+	t.Setenv("ENCRYPTION_PGP_PUBLIC_KEY_FILE", "")
+	enc, err := encryption.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := exportServer(t, testArchive(t, 1<<20))
+	dest := failingDestination{limit: 256 << 10}
+	_, err = sealExport(context.Background(), client, enc, dest, "export-id", "wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip", nil)
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("got %v, want the upload error", err)
+	}
+	if code := exitCode(context.Background(), err); code != exitUpload {
+		t.Errorf("exit code %d, want %d for a failed upload", code, exitUpload)
+	}
+}
+
+func TestReconcileExportsOnlyTouchesOwnExports(t *testing.T) {
+	quietLog(t)
+	t.Setenv("SAVE_DIR", t.TempDir())
+	t.Setenv("REUSE_EXPORT_MAX_AGE", "6h")
+	t.Setenv("STALE_EXPORT_MAX_AGE", "48h")
+	for _, id := range []string{"own-stale", "own-fresh", "deleted"} {
+		if err := file.RecordExport(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	exports := []map[string]any{
+		{"id": "own-stale", "state": api.StateComplete, "format": api.FormatMarkdown, "createdAt": now.Add(-72 * time.Hour), "user": map[string]string{"id": "backup"}},
+		{"id": "own-fresh", "state": api.StateComplete, "format": api.FormatMarkdown, "createdAt": now.Add(-time.Hour), "user": map[string]string{"id": "backup"}},
+		{"id": "hand-stale", "state": api.StateComplete, "format": api.FormatMarkdown, "createdAt": now.Add(-72 * time.Hour), "user": map[string]string{"id": "backup"}},
+		{"id": "hand-fresh", "state": api.StateComplete, "format": api.FormatMarkdown, "createdAt": now.Add(-time.Hour), "user": map[string]string{"id": "backup"}},
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth.info":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"user": map[string]string{"id": "backup"}}})
+		case "/api/fileOperations.list":
+			json.NewEncoder(w).Encode(map[string]any{"data": exports})
+		case "/api/fileOperations.delete":
+			var body struct{ ID string }
+			json.NewDecoder(r.Body).Decode(&body)
+			deleted = append(deleted, body.ID)
+			json.NewEncoder(w).Encode(map[string]any{"success": true})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client, err := api.NewClient(api.Options{BaseURL: server.URL, Token: "test-token", Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reusable := reconcileExports(context.Background(), client)
+	if len(reusable) != 1 || reusable[0].ID != "own-fresh" {
+		t.Errorf("reusable = %+v, want only own-fresh", reusable)
+	}
+	if !slices.Equal(deleted, []string{"own-stale"}) {
+		t.Errorf("deleted %q, want only own-stale", deleted)
+	}
+	started, err := file.StartedExports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 1 || !started["own-fresh"] {
+		t.Errorf("still recorded %v, want only own-fresh", started)
+	}
+}
+
+func TestStreamExportVerifies(t *testing.T) {
+	quietLog(t)
+	const key = "wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip"
+	valid := testArchive(t, 256<<10)
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	for _, tt := range []struct {
+		name    string
+		archive []byte
+		ok      bool
+	}{
+		{"valid", valid, true},
+		{"corrupt", corrupt, false},
+		{"not a zip", []byte("<html>Service Unavailable</html>"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			client := exportServer(t, tt.archive)
+			_, err := streamExport(context.Background(), client, storage.NewLocal(dir), "export-id", key, nil)
+			_, statErr := os.Stat(filepath.Join(dir, key))
+			if tt.ok {
+				if err != nil || statErr != nil {
+					t.Errorf("got %v, archive stored: %v", err, statErr)
+				}
+				return
+			}
+			if code := exitCode(context.Background(), err); code != exitDownload {
+				t.Errorf("got %v with exit code %d, want %d", err, code, exitDownload)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("unverified archive was kept: %v", statErr)
+			}
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
-	"strconv"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -35,9 +39,47 @@ type ProgressResponse struct {
 	Ok     bool `json:"ok"`
 }
 
-var exportStates = make(map[string]string)
+type export struct {
+	State        string
+	Format       string
+	CollectionID string
+	Created      time.Time
+	Completed    time.Time
+}
+
+// mockUserID is the user every API key of the mock server belongs to.
+const mockUserID = "2f1e0d9c-8b7a-4c6d-5e4f-3a2b1c0d9e8f"
+
+type Collection struct {
+	ID    string `json:"id"`
+	URLID string `json:"urlId"`
+	Name  string `json:"name"`
+	// empty collections export without documents or attachments
+	empty bool
+}
+
+var collections = []Collection{
+	{ID: "6b5f3c2e-1a4d-4e8b-9c7f-0d2a1b3c4d5e", URLID: "eng8h2KdLq", Name: "Engineering"},
+	{ID: "7c6a4d3f-2b5e-4f9c-8d1a-1e3b2c4d5e6f", URLID: "hr3Jk9PqWx", Name: "HR & People"},
+	{ID: "8d7b5e4a-3c6f-4a1d-9e2b-2f4c3d5e6f7a", URLID: "ops5Tz1MnB", Name: "Operations"},
+	{ID: "9e8c6f5b-4d7a-4b2e-8f3c-3a5d4e6f7a8b", URLID: "arc7Wy4RsC", Name: "Archive", empty: true},
+}
+
+var exports = make(map[string]*export)
 var exportCounter = 0
 
+var supportedFormats = map[string]bool{
+	"outline-markdown": true,
+	"html":             true,
+	"json":             true,
+}
+
+var archiveNames = map[string]string{
+	"outline-markdown": "outline-backup-markdown.zip",
+	"html":             "outline-backup-html.zip",
+	"json":             "outline-backup-json.zip",
+}
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -45,11 +87,23 @@ func main() {
 	}
 
 	http.HandleFunc("/api/collections.export_all", handleExportAll)
+	http.HandleFunc("/api/collections.export", handleCollectionExport)
+	http.HandleFunc("/api/collections.list", handleCollectionsList)
 	http.HandleFunc("/api/fileOperations.info", handleFileOperationInfo)
 	http.HandleFunc("/api/fileOperations.redirect", handleFileOperationRedirect)
 	http.HandleFunc("/api/fileOperations.delete", handleFileOperationDelete)
+	http.HandleFunc("/api/fileOperations.list", handleFileOperationsList)
+	http.HandleFunc("/api/auth.info", handleAuthInfo)
+	http.HandleFunc("/storage/", handleStorage)
 	http.HandleFunc("/health", handleHealth)
 
+	// Simulate exports left behind by crashed runs
+	if os.Getenv("SEED_ORPHANED_EXPORTS") == "true" {
+		now := time.Now()
+		exports["orphan-recent"] = &export{State: "complete", Format: "outline-markdown", Created: now.Add(-time.Hour), Completed: now.Add(-time.Hour)}
+		exports["orphan-stale"] = &export{State: "complete", Format: "outline-markdown", Created: now.Add(-72 * time.Hour), Completed: now.Add(-72 * time.Hour)}
+	}
+
 	log.Printf("Mock Outline server starting on port %s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
@@ -72,11 +126,116 @@ func handleExportAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var requestBody struct {
+		Format string `json:"format"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	startExport(w, requestBody.Format, "")
+}
+
+func handleCollectionExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check authorization
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer test-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var requestBody struct {
+		ID     string `json:"id"`
+		Format string `json:"format"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	found := false
+	for _, collection := range collections {
+		if collection.ID == requestBody.ID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	startExport(w, requestBody.Format, requestBody.ID)
+}
+
+func handleCollectionsList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check authorization
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer test-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var requestBody struct {
+		Offset int `json:"offset"`
+		Limit  int `json:"limit"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Cap the page size so clients have to paginate
+	limit := requestBody.Limit
+	if limit <= 0 || limit > 2 {
+		limit = 2
+	}
+	offset := min(max(requestBody.Offset, 0), len(collections))
+	end := min(offset+limit, len(collections))
+
+	response := map[string]any{
+		"data": collections[offset:end],
+		"pagination": map[string]any{
+			"offset": offset,
+			"limit":  limit,
+		},
+		"status": 200,
+		"ok":     true,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func startExport(w http.ResponseWriter, format, collectionID string) {
+	if format == "" {
+		format = "outline-markdown"
+	}
+	if !supportedFormats[format] {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
 	exportCounter++
 	exportID := fmt.Sprintf("export-%d", exportCounter)
 
 	// Initialize export state as "processing"
-	exportStates[exportID] = "processing"
+	exp := &export{State: "processing", Format: format, CollectionID: collectionID, Created: time.Now()}
+	exports[exportID] = exp
 
 	response := ExportResponse{
 		Success: true,
@@ -96,8 +255,8 @@ func handleExportAll(w http.ResponseWriter, r *http.Request) {
 			}{
 				ID:     exportID,
 				State:  "processing",
-				Name:   "outline-backup.zip",
-				Format: "outline-markdown",
+				Name:   archiveNames[format],
+				Format: format,
 			},
 		},
 		Status: 200,
@@ -110,7 +269,8 @@ func handleExportAll(w http.ResponseWriter, r *http.Request) {
 	// Simulate async processing - mark as complete after a delay
 	go func() {
 		time.Sleep(2 * time.Second)
-		exportStates[exportID] = "complete"
+		exp.Completed = time.Now()
+		exp.State = "complete"
 	}()
 }
 
@@ -137,7 +297,7 @@ func handleFileOperationInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	exportID := requestBody.ID
-	state, exists := exportStates[exportID]
+	exp, exists := exports[exportID]
 	if !exists {
 		http.Error(w, "Export not found", http.StatusNotFound)
 		return
@@ -151,9 +311,9 @@ func handleFileOperationInfo(w http.ResponseWriter, r *http.Request) {
 			Name   string `json:"name"`
 		}{
 			ID:     exportID,
-			State:  state,
-			Format: "outline-markdown",
-			Name:   "outline-backup.zip",
+			State:  exp.State,
+			Format: exp.Format,
+			Name:   archiveNames[exp.Format],
 		},
 		Status: 200,
 		Ok:     true,
@@ -186,25 +346,46 @@ func handleFileOperationRedirect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	exportID := requestBody.ID
-	state, exists := exportStates[exportID]
+	exp, exists := exports[exportID]
 	if !exists {
 		http.Error(w, "Export not found", http.StatusNotFound)
 		return
 	}
 
-	if state != "complete" {
+	if exp.State != "complete" {
 		http.Error(w, "Export not ready", http.StatusBadRequest)
 		return
 	}
 
-	// Create a fake ZIP file content
-	fakeZipContent := []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x00\x00\x00fake-outline-backup-content")
+	// Like Outline with S3 storage, redirect to a signed storage URL
+	http.Redirect(w, r, "/storage/"+exportID+"?signature=mock", http.StatusFound)
+}
+
+// handleStorage stands in for the object storage Outline redirects to. It
+// serves through http.ServeContent so Range requests work.
+func handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	exportID := strings.TrimPrefix(r.URL.Path, "/storage/")
+	exp, exists := exports[exportID]
+	if !exists || exp.State != "complete" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := buildArchive(exp)
+	if err != nil {
+		http.Error(w, "Failed to build archive", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=outline-backup.zip")
-	w.Header().Set("Content-Length", strconv.Itoa(len(fakeZipContent)))
+	w.Header().Set("Content-Disposition", "attachment; filename="+archiveNames[exp.Format])
 
-	w.Write(fakeZipContent)
+	http.ServeContent(w, r, archiveNames[exp.Format], exp.Completed, bytes.NewReader(content))
 }
 
 func handleFileOperationDelete(w http.ResponseWriter, r *http.Request) {
@@ -230,14 +411,177 @@ func handleFileOperationDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	exportID := requestBody.ID
-	if _, exists := exportStates[exportID]; !exists {
+	if _, exists := exports[exportID]; !exists {
 		http.Error(w, "Export not found", http.StatusNotFound)
 		return
 	}
 
 	// Delete the export
-	delete(exportStates, exportID)
+	delete(exports, exportID)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Export deleted successfully"))
 }
+
+// buildArchive creates a small but valid export archive laid out like the
+// ones Outline produces for the export's format and collection.
+func buildArchive(exp *export) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	add := func(name string, data []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	if exp.Format == "json" {
+		metadata, _ := json.Marshal(map[string]string{"exportVersion": "1", "version": "mock"})
+		if err := add("metadata.json", metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, collection := range collections {
+		if (exp.CollectionID != "" && collection.ID != exp.CollectionID) || collection.empty {
+			continue
+		}
+
+		docs := []string{"Welcome", "Handbook"}
+		switch exp.Format {
+		case "json":
+			documents := make(map[string]any)
+			for i, title := range docs {
+				id := fmt.Sprintf("%s-doc-%d", collection.URLID, i)
+				documents[id] = map[string]string{"id": id, "title": title, "text": "# " + title}
+			}
+			data, _ := json.Marshal(map[string]any{"collection": collection, "documents": documents})
+			if err := add(collection.Name+".json", data); err != nil {
+				return nil, err
+			}
+		case "html":
+			for _, title := range docs {
+				if err := add(collection.Name+"/"+title+".html", []byte("<h1>"+title+"</h1>")); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			for _, title := range docs {
+				if err := add(collection.Name+"/"+title+".md", []byte("# "+title+"\n")); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if err := add("uploads/"+collection.URLID+"/logo.png", []byte("\x89PNG\r\n\x1a\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func handleFileOperationsList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check authorization
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer test-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var requestBody struct {
+		Type   string `json:"type"`
+		Offset int    `json:"offset"`
+		Limit  int    `json:"limit"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var data []map[string]any
+	if requestBody.Type == "" || requestBody.Type == "export" {
+		// Newest first like Outline, so that pages don't depend on the
+		// order of the map
+		ids := slices.Collect(maps.Keys(exports))
+		slices.SortFunc(ids, func(a, b string) int {
+			if c := exports[b].Created.Compare(exports[a].Created); c != 0 {
+				return c
+			}
+			return strings.Compare(a, b)
+		})
+		for _, id := range ids {
+			exp := exports[id]
+			op := map[string]any{
+				"id":        id,
+				"type":      "export",
+				"state":     exp.State,
+				"format":    exp.Format,
+				"name":      archiveNames[exp.Format],
+				"createdAt": exp.Created,
+				"user":      map[string]string{"id": mockUserID},
+			}
+			if exp.CollectionID != "" {
+				op["collectionId"] = exp.CollectionID
+			}
+			data = append(data, op)
+		}
+	}
+
+	limit := requestBody.Limit
+	if limit <= 0 || limit > 25 {
+		limit = 25
+	}
+	offset := min(max(requestBody.Offset, 0), len(data))
+	end := min(offset+limit, len(data))
+
+	response := map[string]any{
+		"data": data[offset:end],
+		"pagination": map[string]any{
+			"offset": offset,
+			"limit":  limit,
+		},
+		"status": 200,
+		"ok":     true,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleAuthInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check authorization
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer test-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := map[string]any{
+		"data": map[string]any{
+			"user": map[string]string{"id": mockUserID, "name": "Mock User"},
+		},
+		"status": 200,
+		"ok":     true,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,106 @@
+// Package notify reports the outcome of backup runs to a webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Values of NOTIFY_ON.
+const (
+	OnFailure = "failure"
+	OnAlways  = "always"
+)
+
+const sendTimeout = 10 * time.Second
+
+// Event describes a finished backup run. Text repeats it as one line, which
+// chat services such as Slack and Mattermost display as the message.
+type Event struct {
+	Text       string    `json:"text"`
+	Success    bool      `json:"success"`
+	ExitCode   int       `json:"exitCode"`
+	Error      string    `json:"error,omitempty"`
+	Instance   string    `json:"instance"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Archives   []Archive `json:"archives,omitempty"`
+}
+
+// Archive summarizes an archive the run stored. Size and SHA256 are those of
+// the stored file, encrypted or not.
+type Archive struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// Webhook posts events as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Always bool
+	client *http.Client
+}
+
+// FromEnv returns the webhook configured by NOTIFY_WEBHOOK_URL and NOTIFY_ON,
+// or nil when no notifications are sent.
+func FromEnv() (*Webhook, error) {
+	target := os.Getenv("NOTIFY_WEBHOOK_URL")
+	if target == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// The URL often holds a token, so it is not repeated
+		return nil, errors.New("NOTIFY_WEBHOOK_URL is invalid (expected an http or https URL)")
+	}
+
+	w := &Webhook{URL: target, client: &http.Client{Timeout: sendTimeout}}
+	switch on := os.Getenv("NOTIFY_ON"); on {
+	case "", OnFailure:
+	case OnAlways:
+		w.Always = true
+	default:
+		return nil, fmt.Errorf("NOTIFY_ON is invalid: %q (expected %q or %q)", on, OnFailure, OnAlways)
+	}
+	return w, nil
+}
+
+// Send posts e unless it reports a success and only failures are sent.
+func (w *Webhook) Send(ctx context.Context, e Event) error {
+	if e.Success && !w.Always {
+		return nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Errors of the client repeat the URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("unable to send notification: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notification webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	t.Setenv("NOTIFY_ON", OnAlways)
+	w, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{
+		Text:    "Outline backup of wiki.example.com succeeded: 1 archive, 12 documents",
+		Success: true,
+		Archives: []Archive{{
+			Name:      "wiki.example.com-outline-backup-markdown-2025-03-15T12:00:00Z.zip",
+			Documents: 12,
+			Size:      4096,
+			SHA256:    "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		}},
+	}
+	if err := w.Send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	archives, ok := got["archives"].([]any)
+	if !ok || len(archives) != 1 {
+		t.Fatalf("archives = %v, want one", got["archives"])
+	}
+	archive := archives[0].(map[string]any)
+	if archive["name"] != event.Archives[0].Name || archive["documents"] != 12.0 || archive["size"] != 4096.0 || archive["sha256"] != event.Archives[0].SHA256 {
+		t.Errorf("archive = %v, want %+v", archive, event.Archives[0])
+	}
+}
+
+func TestSendOnlyFailures(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	t.Setenv("NOTIFY_ON", "")
+	w, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Send(context.Background(), Event{Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Send(context.Background(), Event{ExitCode: 3, Error: "export failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("sent %d notifications, want only the failure", requests)
+	}
+}
@@ -0,0 +1,269 @@
+// Package retention decides which backups to keep under a
+// grandfather-father-son policy.
+package retention
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+// Policy selects the backups to keep. A backup is kept if any rule selects
+// it, or if there are no count rules at all. Count rules apply to each series
+// of backups separately. The zero Policy keeps everything.
+type Policy struct {
+	// Last keeps the newest backups of each series.
+	Last int
+	// Daily, Weekly, Monthly and Yearly keep the newest backup of that many
+	// of the most recent days, ISO weeks, months and years that have one.
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// MinAge keeps every backup younger than this.
+	MinAge time.Duration
+	// MaxSize, in bytes, drops the oldest of the backups selected above
+	// until their total size across all series fits. The newest backup of
+	// each series and backups younger than MinAge are always kept.
+	MaxSize int64
+}
+
+// IsZero reports whether p keeps everything.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+func (p Policy) String() string {
+	if p.IsZero() {
+		return "keep all"
+	}
+
+	var rules []string
+	for _, r := range []struct {
+		name  string
+		count int
+	}{{"last", p.Last}, {"daily", p.Daily}, {"weekly", p.Weekly}, {"monthly", p.Monthly}, {"yearly", p.Yearly}} {
+		if r.count > 0 {
+			rules = append(rules, fmt.Sprintf("%s %d", r.name, r.count))
+		}
+	}
+	if p.MinAge > 0 {
+		rules = append(rules, "min age "+p.MinAge.String())
+	}
+	if p.MaxSize > 0 {
+		rules = append(rules, fmt.Sprintf("max size %d bytes", p.MaxSize))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Backup is a stored archive and the time it was taken.
+type Backup struct {
+	storage.Object
+	Time time.Time
+	// Series groups backups of the same data, such as the markdown export
+	// of one collection, so that each run's archives are counted once per
+	// series rather than competing with each other.
+	Series string
+}
+
+// Decision is the verdict on a single backup.
+type Decision struct {
+	Backup
+	Keep    bool
+	Reasons []string
+}
+
+// Apply decides on every backup, returning the decisions newest first.
+func (p Policy) Apply(backups []Backup, now time.Time) []Decision {
+	decisions := make([]Decision, len(backups))
+	for i, b := range backups {
+		decisions[i] = Decision{Backup: b}
+	}
+	slices.SortStableFunc(decisions, func(a, b Decision) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	if p.IsZero() {
+		for i := range decisions {
+			decisions[i].keep("no retention policy")
+		}
+		return decisions
+	}
+
+	if p.Last == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0 && p.Yearly == 0 {
+		// Only a size limit, which applies to all backups
+		for i := range decisions {
+			decisions[i].keep("no count rule")
+		}
+	}
+
+	// Indexes of each series' backups, newest first
+	series := make(map[string][]int)
+	newest := make([]bool, len(decisions))
+	for i, d := range decisions {
+		if len(series[d.Series]) == 0 {
+			newest[i] = true
+		}
+		series[d.Series] = append(series[d.Series], i)
+	}
+	for _, group := range series {
+		for n, i := range group {
+			if n < p.Last {
+				decisions[i].keep(fmt.Sprintf("last %d", p.Last))
+			}
+		}
+		p.keepPeriods(decisions, group, "daily", p.Daily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+		p.keepPeriods(decisions, group, "weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		})
+		p.keepPeriods(decisions, group, "monthly", p.Monthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+		p.keepPeriods(decisions, group, "yearly", p.Yearly, func(t time.Time) string {
+			return t.Format("2006")
+		})
+	}
+
+	young := make([]bool, len(decisions))
+	if p.MinAge > 0 {
+		for i := range decisions {
+			if now.Sub(decisions[i].Time) < p.MinAge {
+				young[i] = true
+				decisions[i].keep("younger than " + p.MinAge.String())
+			}
+		}
+	}
+
+	if p.MaxSize > 0 {
+		var total int64
+		for i := range decisions {
+			d := &decisions[i]
+			if !d.Keep {
+				continue
+			}
+			total += d.Size
+			if total > p.MaxSize && !newest[i] && !young[i] {
+				d.Keep = false
+				d.Reasons = []string{fmt.Sprintf("over maximum total size of %d bytes", p.MaxSize)}
+				total -= d.Size
+			}
+		}
+	}
+
+	for i := range decisions {
+		if !decisions[i].Keep && len(decisions[i].Reasons) == 0 {
+			decisions[i].Reasons = []string{"not selected by any rule"}
+		}
+	}
+	return decisions
+}
+
+// keepPeriods keeps the newest backup of each of the count most recent
+// periods, as named by period, among the decisions at the indexes in group.
+func (p Policy) keepPeriods(decisions []Decision, group []int, rule string, count int, period func(time.Time) string) {
+	if count <= 0 {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, i := range group {
+		if len(seen) == count {
+			return
+		}
+		name := period(decisions[i].Time)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		decisions[i].keep(rule + " " + name)
+	}
+}
+
+func (d *Decision) keep(reason string) {
+	d.Keep = true
+	d.Reasons = append(d.Reasons, reason)
+}
+
+// PolicyFromEnv reads a policy from the variables named prefix followed by
+// KEEP_BACKUPS, KEEP_DAILY, KEEP_WEEKLY, KEEP_MONTHLY, KEEP_YEARLY,
+// KEEP_MIN_AGE and KEEP_MAX_SIZE.
+func PolicyFromEnv(prefix string) (Policy, error) {
+	var p Policy
+
+	counts := []struct {
+		key string
+		dst *int
+	}{
+		{"KEEP_BACKUPS", &p.Last},
+		{"KEEP_DAILY", &p.Daily},
+		{"KEEP_WEEKLY", &p.Weekly},
+		{"KEEP_MONTHLY", &p.Monthly},
+		{"KEEP_YEARLY", &p.Yearly},
+	}
+	for _, c := range counts {
+		key := prefix + c.key
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("%s is invalid: %q (expected a positive number)", key, value)
+		}
+		*c.dst = n
+	}
+
+	if value := os.Getenv(prefix + "KEEP_MIN_AGE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("%sKEEP_MIN_AGE is invalid: %q (expected a positive duration such as 72h)", prefix, value)
+		}
+		p.MinAge = d
+	}
+
+	if value := os.Getenv(prefix + "KEEP_MAX_SIZE"); value != "" {
+		size, err := ParseSize(value)
+		if err != nil || size <= 0 {
+			return p, fmt.Errorf("%sKEEP_MAX_SIZE is invalid: %q (expected a size such as 50GiB)", prefix, value)
+		}
+		p.MaxSize = size
+	}
+
+	return p, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count such as "500MB", "50GiB" or "1024".
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n * float64(multiplier)), nil
+}
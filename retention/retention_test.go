@@ -0,0 +1,155 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stenstromen/outlinewikibackup/storage"
+)
+
+var now = time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+
+var allSeries = []string{"markdown-eng-a1", "markdown-ops-b2", "json-eng-a1", "json-ops-b2"}
+
+// daily returns one backup of each series for each of the last days days,
+// one second apart within a run.
+func daily(days int, series []string) []Backup {
+	var backups []Backup
+	for day := range days {
+		run := now.AddDate(0, 0, -day)
+		for i, s := range series {
+			t := run.Add(time.Duration(i) * time.Second)
+			backups = append(backups, Backup{
+				Object: storage.Object{Key: fmt.Sprintf("%s-%s", s, t.Format(time.RFC3339)), Size: 100},
+				Time:   t,
+				Series: s,
+			})
+		}
+	}
+	return backups
+}
+
+func kept(decisions []Decision) map[string]int {
+	counts := make(map[string]int)
+	for _, d := range decisions {
+		if d.Keep {
+			counts[d.Series]++
+		}
+	}
+	return counts
+}
+
+func TestApplyCountsEachSeries(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		backups []Backup
+		want    int
+	}{
+		{"last", Policy{Last: 3}, daily(10, allSeries), 3},
+		{"daily", Policy{Daily: 7}, daily(10, allSeries), 7},
+		{"weekly", Policy{Weekly: 2}, daily(10, allSeries), 2},
+		{"daily and monthly", Policy{Daily: 3, Monthly: 2}, daily(40, allSeries), 4},
+		{"min age", Policy{Last: 1, MinAge: 71 * time.Hour}, daily(10, allSeries), 3},
+		{"no count rule", Policy{MinAge: time.Hour}, daily(5, allSeries), 5},
+		{"zero", Policy{}, daily(5, allSeries), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := tt.policy.Apply(tt.backups, now)
+			if len(decisions) != len(tt.backups) {
+				t.Fatalf("got %d decisions for %d backups", len(decisions), len(tt.backups))
+			}
+			counts := kept(decisions)
+			for _, s := range allSeries {
+				if counts[s] != tt.want {
+					t.Errorf("kept %d backups of %s, want %d", counts[s], s, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyKeepsLatestRun(t *testing.T) {
+	decisions := Policy{Last: 1}.Apply(daily(3, allSeries), now)
+	for _, d := range decisions {
+		latest := d.Time.Sub(now) < time.Minute && !d.Time.Before(now)
+		if d.Keep != latest {
+			t.Errorf("%s: keep = %v, want %v (%v)", d.Key, d.Keep, latest, d.Reasons)
+		}
+		if len(d.Reasons) == 0 {
+			t.Errorf("%s: no reason given", d.Key)
+		}
+	}
+}
+
+func TestApplyNewestFirst(t *testing.T) {
+	decisions := Policy{Last: 100}.Apply(daily(5, allSeries[:1]), now)
+	for i := 1; i < len(decisions); i++ {
+		if decisions[i].Time.After(decisions[i-1].Time) {
+			t.Fatalf("decision %d is newer than decision %d", i, i-1)
+		}
+	}
+}
+
+func TestApplyMaxSize(t *testing.T) {
+	// 40 backups of 100 bytes, but room for 10
+	decisions := Policy{Daily: 10, MaxSize: 1000}.Apply(daily(10, allSeries), now)
+	var total int64
+	for _, d := range decisions {
+		if d.Keep {
+			total += d.Size
+		}
+	}
+	if total > 1000 {
+		t.Errorf("kept %d bytes, want at most 1000", total)
+	}
+	counts := kept(decisions)
+	for _, s := range allSeries {
+		if counts[s] == 0 {
+			t.Errorf("the newest backup of %s was deleted", s)
+		}
+	}
+
+	// The newest backup of each series is kept even if it doesn't fit
+	decisions = Policy{Last: 1, MaxSize: 1}.Apply(daily(2, allSeries), now)
+	for s, n := range kept(decisions) {
+		if n != 1 {
+			t.Errorf("kept %d backups of %s, want 1", n, s)
+		}
+	}
+	if len(kept(decisions)) != len(allSeries) {
+		t.Errorf("kept backups of %d series, want %d", len(kept(decisions)), len(allSeries))
+	}
+}
+
+func TestApplyMaxSizeSparesYoung(t *testing.T) {
+	decisions := Policy{Last: 5, MinAge: 36 * time.Hour, MaxSize: 1}.Apply(daily(5, allSeries[:1]), now)
+	counts := kept(decisions)
+	if counts[allSeries[0]] != 2 {
+		t.Errorf("kept %d backups, want the 2 younger than the minimum age", counts[allSeries[0]])
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"500MB", 500_000_000, true},
+		{"50GiB", 50 << 30, true},
+		{"1.5KiB", 1536, true},
+		{"", 0, false},
+		{"GiB", 0, false},
+		{"5XB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -2,85 +2,244 @@ package s3api
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyauth "github.com/aws/smithy-go/auth"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
-func GetConfig() aws.Config {
-	var cfg aws.Config
-	var err error
+const (
+	ChecksumWhenSupported = "when_supported"
+	ChecksumWhenRequired  = "when_required"
+)
+
+// preset holds the defaults of an S3 compatible provider.
+type preset struct {
+	// endpoint is a template for the endpoint URL, with %s standing for the
+	// region. Providers without one need Endpoint to be set.
+	endpoint  string
+	region    string
+	pathStyle bool
+	checksum  string
+}
+
+var presets = map[string]preset{
+	"aws":    {checksum: ChecksumWhenSupported},
+	"minio":  {region: "us-east-1", pathStyle: true, checksum: ChecksumWhenRequired},
+	"garage": {region: "garage", pathStyle: true, checksum: ChecksumWhenRequired},
+	"ceph":   {region: "us-east-1", pathStyle: true, checksum: ChecksumWhenRequired},
+	"r2":     {region: "auto", checksum: ChecksumWhenRequired},
+	"b2":     {endpoint: "https://s3.%s.backblazeb2.com", checksum: ChecksumWhenRequired},
+	"wasabi": {endpoint: "https://s3.%s.wasabisys.com", region: "us-east-1", checksum: ChecksumWhenRequired},
+}
+
+// Providers returns the names of the supported S3 compatible providers.
+func Providers() []string {
+	return slices.Sorted(maps.Keys(presets))
+}
 
-	if endpoint := os.Getenv("MINIO_ENDPOINT"); endpoint != "" {
-		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
-			endpoint = "https://" + endpoint
+// Settings describes an S3 compatible service and the credentials to use
+// with it. Zero values take the defaults of Provider.
+type Settings struct {
+	// Provider selects the defaults for a service: aws (the default), minio,
+	// garage, ceph, r2, b2 or wasabi.
+	Provider string
+	// Endpoint is the URL of the service. It is derived from Region for b2
+	// and wasabi, and must be set for the other providers except aws.
+	Endpoint string
+	Region   string
+	// SigningRegion overrides Region when signing requests.
+	SigningRegion string
+	// PathStyle addresses buckets as a path instead of a host name.
+	PathStyle *bool
+	// ChecksumMode is ChecksumWhenSupported or ChecksumWhenRequired. Many S3
+	// compatible services reject the checksums the SDK sends by default.
+	ChecksumMode string
+	// InsecureSkipVerify disables TLS certificate verification, for
+	// services with self-signed certificates.
+	InsecureSkipVerify bool
+	// Empty credentials select the default AWS credential chain.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// DefaultSettings reads the single S3/MinIO destination configured by the
+// S3_* variables, falling back to MINIO_ENDPOINT, GARAGE_ENDPOINT and
+// AWS_REGION.
+func DefaultSettings() (Settings, error) {
+	s, err := SettingsFromEnv("S3_")
+	if err != nil {
+		return s, err
+	}
+
+	if s.Provider == "" && s.Endpoint == "" {
+		if endpoint := os.Getenv("MINIO_ENDPOINT"); endpoint != "" {
+			s.Provider, s.Endpoint = "minio", endpoint
+		} else if endpoint := os.Getenv("GARAGE_ENDPOINT"); endpoint != "" {
+			s.Provider, s.Endpoint = "garage", endpoint
 		}
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_REGION")
+	}
+	return s, nil
+}
 
-		cfg, err = config.LoadDefaultConfig(context.Background(),
-			config.WithRegion("us-east-1"),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				os.Getenv("AWS_ACCESS_KEY_ID"),
-				os.Getenv("AWS_SECRET_ACCESS_KEY"),
-				"",
-			)),
-			config.WithEndpointResolver(aws.EndpointResolverFunc(
-				func(service, region string) (aws.Endpoint, error) {
-					return aws.Endpoint{
-						PartitionID:       "aws",
-						URL:               endpoint,
-						SigningRegion:     "us-east-1",
-						HostnameImmutable: true,
-					}, nil
-				},
-			)),
-			config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
-		)
+// SettingsFromEnv reads settings from the variables named prefix followed by
+// PROVIDER, ENDPOINT, REGION, SIGNING_REGION, FORCE_PATH_STYLE,
+// CHECKSUM_MODE, INSECURE_SKIP_VERIFY, ACCESS_KEY_ID and SECRET_ACCESS_KEY.
+func SettingsFromEnv(prefix string) (Settings, error) {
+	s := Settings{
+		Provider:        strings.ToLower(os.Getenv(prefix + "PROVIDER")),
+		Endpoint:        os.Getenv(prefix + "ENDPOINT"),
+		Region:          os.Getenv(prefix + "REGION"),
+		SigningRegion:   os.Getenv(prefix + "SIGNING_REGION"),
+		ChecksumMode:    strings.ToLower(os.Getenv(prefix + "CHECKSUM_MODE")),
+		AccessKeyID:     os.Getenv(prefix + "ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv(prefix + "SECRET_ACCESS_KEY"),
+	}
+
+	if value := os.Getenv(prefix + "FORCE_PATH_STYLE"); value != "" {
+		pathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return s, fmt.Errorf("%sFORCE_PATH_STYLE is invalid: %q (expected true or false)", prefix, value)
+		}
+		s.PathStyle = &pathStyle
+	}
+	if value := os.Getenv(prefix + "INSECURE_SKIP_VERIFY"); value != "" {
+		skip, err := strconv.ParseBool(value)
 		if err != nil {
-			log.Fatal("Failed to create MinIO config:", err)
+			return s, fmt.Errorf("%sINSECURE_SKIP_VERIFY is invalid: %q (expected true or false)", prefix, value)
 		}
-		return cfg
+		s.InsecureSkipVerify = skip
 	}
-	// TODO: Garage really cares only about signing region, so
-	// almost same as minio - merge?
-	if endpoint := os.Getenv("GARAGE_ENDPOINT"); endpoint != "" {
-		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
-			endpoint = "https://" + endpoint
+
+	return s, nil
+}
+
+// resolve applies the provider defaults to s and checks the result.
+func (s Settings) resolve() (Settings, error) {
+	if s.Provider == "" {
+		s.Provider = "aws"
+		if s.Endpoint != "" {
+			// A custom endpoint without a provider is most likely MinIO
+			s.Provider = "minio"
 		}
+	}
+	p, ok := presets[s.Provider]
+	if !ok {
+		return s, fmt.Errorf("unknown S3 provider %q (expected aws, minio, garage, ceph, r2, b2 or wasabi)", s.Provider)
+	}
 
-		cfg, err = config.LoadDefaultConfig(context.Background(),
-			config.WithRegion("us-east-1"),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				os.Getenv("AWS_ACCESS_KEY_ID"),
-				os.Getenv("AWS_SECRET_ACCESS_KEY"),
-				"",
-			)),
-			config.WithEndpointResolver(aws.EndpointResolverFunc(
-				func(service, region string) (aws.Endpoint, error) {
-					return aws.Endpoint{
-						PartitionID:       "aws",
-						URL:               endpoint,
-						SigningRegion:     "garage",
-						HostnameImmutable: true,
-					}, nil
-				},
-			)),
+	if s.Region == "" {
+		s.Region = p.region
+	}
+	if s.Endpoint == "" && p.endpoint != "" {
+		if s.Region == "" {
+			return s, fmt.Errorf("a region is required for S3 provider %q", s.Provider)
+		}
+		s.Endpoint = fmt.Sprintf(p.endpoint, s.Region)
+	}
+	if s.Endpoint == "" && s.Provider != "aws" {
+		return s, fmt.Errorf("an endpoint is required for S3 provider %q", s.Provider)
+	}
+	if s.Endpoint != "" && !strings.HasPrefix(s.Endpoint, "http://") && !strings.HasPrefix(s.Endpoint, "https://") {
+		s.Endpoint = "https://" + s.Endpoint
+	}
+	if s.PathStyle == nil {
+		s.PathStyle = aws.Bool(p.pathStyle)
+	}
+
+	switch s.ChecksumMode {
+	case "":
+		s.ChecksumMode = p.checksum
+	case ChecksumWhenSupported, ChecksumWhenRequired:
+	default:
+		return s, fmt.Errorf("unknown checksum mode %q (expected %s or %s)", s.ChecksumMode, ChecksumWhenSupported, ChecksumWhenRequired)
+	}
+
+	return s, nil
+}
+
+// NewClient returns an S3 client for the service described by s. It does not
+// contact the service.
+func NewClient(ctx context.Context, s Settings) (*s3.Client, error) {
+	s, err := s.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(s.Region),
+	}
+	if s.AccessKeyID != "" || s.SecretAccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			s.AccessKeyID,
+			s.SecretAccessKey,
+			"",
+		)))
+	}
+	if s.ChecksumMode == ChecksumWhenRequired {
+		opts = append(opts,
 			config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+			config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
 		)
-		if err != nil {
-			log.Fatal("Failed to create Garage config:", err)
-		}
-		return cfg
 	}
-	cfg, err = config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(os.Getenv("AWS_REGION")),
-	)
+	if s.InsecureSkipVerify {
+		opts = append(opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		})))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load S3 config: %w", err)
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s.Endpoint)
+		}
+		o.UsePathStyle = *s.PathStyle
+		if s.SigningRegion != "" && s.SigningRegion != s.Region {
+			o.EndpointResolverV2 = signingRegionResolver{
+				EndpointResolverV2: s3.NewDefaultEndpointResolverV2(),
+				region:             s.SigningRegion,
+			}
+		}
+	}), nil
+}
 
+// signingRegionResolver resolves endpoints as usual but signs requests for a
+// fixed region.
+type signingRegionResolver struct {
+	s3.EndpointResolverV2
+	region string
+}
+
+func (r signingRegionResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	endpoint, err := r.EndpointResolverV2.ResolveEndpoint(ctx, params)
 	if err != nil {
-		log.Fatal("Failed to create S3 config:", err)
+		return endpoint, err
+	}
+
+	options, _ := smithyauth.GetAuthOptions(&endpoint.Properties)
+	for _, option := range options {
+		smithyhttp.SetSigV4SigningRegion(&option.SignerProperties, r.region)
+		smithyhttp.SetSigV4ASigningRegions(&option.SignerProperties, []string{r.region})
 	}
-	return cfg
+	return endpoint, nil
 }
@@ -0,0 +1,114 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		spec string
+		from string
+		want []string
+	}{
+		{"0 2 * * *", "2025-03-10 01:59", []string{"2025-03-10 02:00", "2025-03-11 02:00"}},
+		{"0 2 * * *", "2025-03-10 02:00", []string{"2025-03-11 02:00"}},
+		{"*/15 * * * *", "2025-03-10 10:07", []string{"2025-03-10 10:15", "2025-03-10 10:30", "2025-03-10 10:45", "2025-03-10 11:00"}},
+		{"0 8-18/4 * * *", "2025-03-10 09:00", []string{"2025-03-10 12:00", "2025-03-10 16:00", "2025-03-11 08:00"}},
+		{"30 1 1,15 * *", "2025-03-02 00:00", []string{"2025-03-15 01:30", "2025-04-01 01:30"}},
+		{"0 0 1 */3 *", "2025-02-10 00:00", []string{"2025-04-01 00:00", "2025-07-01 00:00"}},
+		{"0 0 29 2 *", "2025-01-01 00:00", []string{"2028-02-29 00:00"}},
+		// 2025-03-10 is a Monday
+		{"0 3 * * 1-5", "2025-03-14 04:00", []string{"2025-03-17 03:00"}},
+		// Both 0 and 7 are Sunday
+		{"0 0 * * 0", "2025-03-10 00:00", []string{"2025-03-16 00:00", "2025-03-23 00:00"}},
+		{"0 0 * * 7", "2025-03-10 00:00", []string{"2025-03-16 00:00", "2025-03-23 00:00"}},
+		// A restricted day of month and day of week match either
+		{"0 0 13 * 5", "2025-03-01 00:00", []string{"2025-03-07 00:00", "2025-03-13 00:00", "2025-03-14 00:00"}},
+		// A restricted day of month with a wildcard day of week matches
+		// only the day of month
+		{"0 0 13 * *", "2025-03-01 00:00", []string{"2025-03-13 00:00", "2025-04-13 00:00"}},
+		{"@daily", "2025-03-10 12:00", []string{"2025-03-11 00:00"}},
+		{"@weekly", "2025-03-10 12:00", []string{"2025-03-16 00:00"}},
+		{"@monthly", "2025-03-10 12:00", []string{"2025-04-01 00:00"}},
+		{"@yearly", "2025-03-10 12:00", []string{"2026-01-01 00:00"}},
+		{"@hourly", "2025-03-10 12:30", []string{"2025-03-10 13:00"}},
+		{"@every 6h", "2025-03-10 12:30", []string{"2025-03-10 18:30", "2025-03-11 00:30"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := date(tt.from)
+			for _, want := range tt.want {
+				next = s.Next(next)
+				if !next.Equal(date(want)) {
+					t.Fatalf("Next = %s, want %s", next.Format("2006-01-02 15:04 Mon"), want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clocks go forward on 2026-03-29 and back on 2026-10-25
+	for _, tt := range []struct {
+		from      time.Time
+		want      time.Time
+		wantHours float64
+	}{
+		{time.Date(2026, 3, 28, 3, 0, 0, 0, berlin), time.Date(2026, 3, 29, 3, 0, 0, 0, berlin), 23},
+		{time.Date(2026, 10, 24, 3, 0, 0, 0, berlin), time.Date(2026, 10, 25, 3, 0, 0, 0, berlin), 25},
+	} {
+		next := s.Next(tt.from)
+		if !next.Equal(tt.want) || next.Hour() != 3 {
+			t.Errorf("Next(%s) = %s, want %s", tt.from, next, tt.want)
+		}
+		if hours := next.Sub(tt.from).Hours(); hours != tt.wantHours {
+			t.Errorf("Next(%s) is %v hours later, want %v", tt.from, hours, tt.wantHours)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"0 0 31 2 *",
+		"@fortnightly",
+		"@every 30s",
+		"@every soon",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package secrets reads secret settings from files named by *_FILE
+// variables and keeps their values out of the log.
+package secrets
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Mask replaces secret values in log output and reports.
+const Mask = "********"
+
+// FileSuffix turns the name of a secret variable into the name of the
+// variable holding the path of a file to read it from.
+const FileSuffix = "_FILE"
+
+var names = []string{
+	"AUTH_TOKEN",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"S3_SECRET_ACCESS_KEY",
+	"S3_SSE_CUSTOMER_KEY",
+	"ENCRYPTION_PGP_PASSPHRASE",
+	"NOTIFY_WEBHOOK_URL",
+}
+
+var destinationName = regexp.MustCompile(`^DEST_[A-Z0-9_]+_(SECRET_ACCESS_KEY|SSE_CUSTOMER_KEY)$`)
+
+// Values shorter than this are not redacted, since replacing them would
+// garble the log rather than protect anything.
+const minRedactLength = 4
+
+var (
+	mu sync.RWMutex
+	// fromFile holds the variables Load set, which it may set again.
+	fromFile = map[string]bool{}
+	// values holds the secrets to redact, longest first.
+	values []string
+)
+
+// IsSecret reports whether the environment variable name holds a secret.
+func IsSecret(name string) bool {
+	return slices.Contains(names, name) || destinationName.MatchString(name)
+}
+
+// Load sets every secret variable whose *_FILE variable is set to the
+// contents of that file, without a trailing newline, and registers all
+// secret values for redaction. It is called before every run, so that
+// rotated secrets are picked up by a daemon. Setting both a variable and its
+// *_FILE variable is an error.
+func Load() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, kv := range os.Environ() {
+		key, path, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutSuffix(key, FileSuffix)
+		if !ok || !IsSecret(name) || path == "" {
+			continue
+		}
+		if os.Getenv(name) != "" && !fromFile[name] {
+			return fmt.Errorf("%s and %s are both set", name, key)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s is invalid: %w", key, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if value == "" {
+			return fmt.Errorf("%s is invalid: %s is empty", key, path)
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+		fromFile[name] = true
+	}
+
+	// Rotated values stay redacted, since they may still be valid
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if IsSecret(key) && len(value) >= minRedactLength && !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	// Replace longer values first, in case one contains another
+	slices.SortFunc(values, func(a, b string) int { return len(b) - len(a) })
+	return nil
+}
+
+// Redact replaces the secret values registered by Load in s.
+func Redact(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, value := range values {
+		s = strings.ReplaceAll(s, value, Mask)
+	}
+	return s
+}
+
+// Writer redacts secret values from everything written through it. The log
+// package writes whole lines, so values are never split across writes.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partSuffix marks files that are still being written.
+const partSuffix = ".part"
+
+// Local keeps archives as files in a directory.
+type Local struct {
+	Dir string
+}
+
+// NewLocal returns a destination for the directory dir.
+func NewLocal(dir string) *Local {
+	return &Local{Dir: filepath.Clean(dir)}
+}
+
+func (l *Local) String() string {
+	return l.Dir
+}
+
+func (l *Local) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(l.Dir, key), nil
+}
+
+// Put writes body to a temporary file next to the target and renames it
+// into place once it has been synced.
+func (l *Local) Put(ctx context.Context, key string, body io.Reader, _ Metadata) (err error) {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory %q: %w", l.Dir, err)
+	}
+
+	tmp, err := os.CreateTemp(l.Dir, key+".*"+partSuffix)
+	if err != nil {
+		return fmt.Errorf("unable to create file in %q: %w", l.Dir, err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, readerWithContext{ctx, body}); err != nil {
+		return fmt.Errorf("unable to write %q: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to rename %q to %q: %w", tmp.Name(), path, err)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%q: %w", key, ErrNotExist)
+	}
+	return f, err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Object, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Object{}, fmt.Errorf("%q: %w", key, ErrNotExist)
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// List returns the regular files in the directory, leaving out files that
+// are still being written.
+func (l *Local) List(ctx context.Context) ([]Object, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files in directory %q: %w", l.Dir, err)
+	}
+
+	var objects []Object
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), partSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat %q: %w", entry.Name(), err)
+		}
+		objects = append(objects, Object{Key: entry.Name(), Size: info.Size(), LastModified: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// readerWithContext stops a copy once ctx is done.
+type readerWithContext struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r readerWithContext) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,669 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3Options configures an S3 destination. Zero PartSize and Concurrency
+// select the upload manager defaults.
+type S3Options struct {
+	Bucket string
+	// Prefix is prepended to every key, for example "outline/". List only
+	// returns objects under it.
+	Prefix      string
+	PartSize    int64
+	Concurrency int
+	// MinimalPermissions marks credentials that may only write and delete
+	// objects, instead of probing for them. Stat then fails with
+	// ErrNotSupported without calling the S3 API, and List reads the index.
+	MinimalPermissions bool
+	// SSE selects server-side encryption of everything written.
+	SSE SSE
+	// Lock is applied to every archive, but not to the index.
+	Lock ObjectLock
+	// StorageClass, Tags and Metadata are set on every archive, but not on
+	// the index, so that lifecycle rules can't expire it. Metadata passed to
+	// Put takes precedence over Metadata.
+	StorageClass types.StorageClass
+	Tags         map[string]string
+	Metadata     Metadata
+}
+
+// Server-side encryption modes.
+const (
+	SSES3  = "sse-s3"
+	SSEKMS = "sse-kms"
+	SSEC   = "sse-c"
+)
+
+// SSE selects how the bucket encrypts stored objects.
+type SSE struct {
+	// Mode is SSES3, SSEKMS, SSEC or empty for the bucket default.
+	Mode string
+	// KMSKeyID is the KMS key for SSEKMS, or empty for the AWS managed key.
+	KMSKeyID string
+	// CustomerKey is the 256-bit key for SSEC. Objects can't be read
+	// without it.
+	CustomerKey []byte
+}
+
+// customerKey returns the algorithm, key and key MD5 to send with every
+// request on an SSE-C object, or nils for other modes.
+func (s SSE) customerKey() (algorithm, key, keyMD5 *string) {
+	if s.Mode != SSEC {
+		return nil, nil, nil
+	}
+	sum := md5.Sum(s.CustomerKey)
+	return aws.String(string(types.ServerSideEncryptionAes256)),
+		aws.String(base64.StdEncoding.EncodeToString(s.CustomerKey)),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// ObjectLock makes stored archives immutable. It needs a bucket created
+// with Object Lock enabled.
+type ObjectLock struct {
+	// Mode and Period set a retention period on every archive, during which
+	// it can't be deleted or overwritten.
+	Mode   types.ObjectLockMode
+	Period time.Duration
+	// LegalHold locks every archive until the hold is removed by hand.
+	LegalHold bool
+}
+
+// IndexKey is the object, under the prefix, that lists the archives written
+// to a bucket that can't be listed.
+const IndexKey = "index.json"
+
+// index is the content of IndexKey.
+type index struct {
+	Objects []Object `json:"objects"`
+}
+
+// S3 keeps archives as objects in an S3 compatible bucket.
+type S3 struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	opts     S3Options
+	checksum bool
+	caps     Capabilities
+
+	// useIndex is set when the bucket can't be listed. Put and Delete then
+	// record keys in IndexKey, and List reads it instead of the bucket.
+	useIndex bool
+	indexMu  sync.Mutex
+}
+
+// NewS3 returns a destination for the bucket in opts using client.
+func NewS3(client *s3.Client, opts S3Options) *S3 {
+	checksums := client.Options().RequestChecksumCalculation
+
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		if opts.PartSize > 0 {
+			u.PartSize = opts.PartSize
+		}
+		if opts.Concurrency > 0 {
+			u.Concurrency = opts.Concurrency
+		}
+		// The uploader would abort with the upload's context, which is
+		// already cancelled when a signal interrupted the upload, so Put
+		// aborts failed uploads itself
+		u.LeavePartsOnError = true
+		// Follow the checksum mode of the client, which many S3 compatible
+		// services need set to "when required".
+		u.RequestChecksumCalculation = checksums
+	})
+
+	caps := Capabilities{Write: true, Read: true, List: true, Delete: true}
+	if opts.MinimalPermissions {
+		caps = Capabilities{Write: true, Delete: true}
+	}
+
+	return &S3{
+		client:   client,
+		uploader: uploader,
+		opts:     opts,
+		checksum: checksums != aws.RequestChecksumCalculationWhenRequired,
+		caps:     caps,
+		useIndex: !caps.List,
+	}
+}
+
+func (d *S3) String() string {
+	return "s3://" + d.opts.Bucket + "/" + d.opts.Prefix
+}
+
+// Put uploads body, as a multipart upload if it is larger than the part
+// size. A failed multipart upload is aborted so that no orphaned parts are
+// left behind. Bodies that can't seek are buffered in memory, up to
+// PartSize times Concurrency bytes at a time. meta is stored as user
+// metadata. If the provider supports checksums and the body fits into a
+// single part, its MetaSHA256 is sent along so that S3 rejects a corrupted
+// upload with ErrChecksum.
+func (d *S3) Put(ctx context.Context, key string, body io.Reader, meta Metadata) error {
+	body, size, err := measure(body)
+	if err != nil {
+		return err
+	}
+	_, seekable := body.(io.Seeker)
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(d.opts.Bucket),
+		Key:    aws.String(d.opts.Prefix + key),
+		Body:   body,
+		ACL:    types.ObjectCannedACLPrivate,
+	}
+	d.encrypt(input)
+	input.StorageClass = d.opts.StorageClass
+	if len(d.opts.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range d.opts.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	if len(d.opts.Metadata) > 0 || len(meta) > 0 {
+		input.Metadata = make(map[string]string)
+		maps.Copy(input.Metadata, d.opts.Metadata)
+		maps.Copy(input.Metadata, meta)
+	}
+	if lock := d.opts.Lock; lock.Mode != "" {
+		input.ObjectLockMode = lock.Mode
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(lock.Period))
+	}
+	if d.opts.Lock.LegalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+	// Locked uploads must carry a checksum, whatever the checksum mode
+	if d.checksum || d.opts.Lock != (ObjectLock{}) {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	// Multipart uploads only have checksums of their parts
+	if sum, err := hex.DecodeString(meta[MetaSHA256]); d.checksum && err == nil && len(sum) == sha256.Size && seekable && size() <= d.uploader.PartSize {
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+
+	_, err = d.uploader.Upload(ctx, input)
+	if err != nil {
+		var multipartErr manager.MultiUploadFailure
+		if errors.As(err, &multipartErr) {
+			d.abort(ctx, key, multipartErr.UploadID())
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && slices.Contains(digestErrors, apiErr.ErrorCode()) {
+			return fmt.Errorf("%w: %q was rejected by %q: %w", ErrChecksum, key, d.opts.Bucket, err)
+		}
+		return fmt.Errorf("unable to upload %q to %q: %w", key, d.opts.Bucket, err)
+	}
+
+	if d.useIndex {
+		return d.updateIndex(ctx, func(idx *index) {
+			idx.remove(key)
+			idx.Objects = append(idx.Objects, Object{Key: key, Size: size(), LastModified: time.Now().UTC()})
+		})
+	}
+	return nil
+}
+
+// Get is tried even if Probe found reading denied, since a policy may allow
+// reading the index alone.
+func (d *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.opts.Bucket),
+		Key:    aws.String(d.opts.Prefix + key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = d.opts.SSE.customerKey()
+	resp, err := d.client.GetObject(ctx, input)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%q: %w", key, ErrNotExist)
+		}
+		if denied(err) {
+			return nil, fmt.Errorf("credentials don't allow GetObject on %q: %w", key, ErrNotSupported)
+		}
+		return nil, fmt.Errorf("unable to get object %q: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+func (d *S3) Stat(ctx context.Context, key string) (Object, error) {
+	if !d.caps.Read {
+		return Object{}, fmt.Errorf("credentials don't allow GetObject: %w", ErrNotSupported)
+	}
+
+	resp, err := d.head(ctx, key)
+	if err != nil {
+		return Object{}, err
+	}
+	obj := Object{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+
+	// Checksums of multipart uploads are of their parts, and end in "-N"
+	if sum, err := base64.StdEncoding.DecodeString(aws.ToString(resp.ChecksumSHA256)); err == nil && len(sum) == sha256.Size {
+		obj.SHA256 = hex.EncodeToString(sum)
+	}
+	// The ETag of a single part upload is its MD5, unless it is encrypted
+	// with a key S3 doesn't manage
+	etag := strings.Trim(aws.ToString(resp.ETag), `"`)
+	if md5Pattern.MatchString(etag) && d.opts.SSE.Mode != SSEKMS && d.opts.SSE.Mode != SSEC {
+		obj.MD5 = etag
+	}
+	return obj, nil
+}
+
+var md5Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// digestErrors are the error codes of uploads rejected for not matching
+// their checksum.
+var digestErrors = []string{"BadDigest", "InvalidDigest", "XAmzContentChecksumMismatch", "XAmzContentSHA256Mismatch"}
+
+func (d *S3) head(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(d.opts.Bucket),
+		Key:    aws.String(d.opts.Prefix + key),
+	}
+	if d.checksum {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = d.opts.SSE.customerKey()
+	resp, err := d.client.HeadObject(ctx, input)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("%q: %w", key, ErrNotExist)
+		}
+		// Without s3:ListBucket, missing objects are reported as 403 even
+		// though reading is allowed
+		if denied(err) && d.caps.Read && !d.caps.List {
+			return nil, fmt.Errorf("%q: %w", key, ErrNotExist)
+		}
+		return nil, fmt.Errorf("unable to stat object %q: %w", key, err)
+	}
+	return resp, nil
+}
+
+// List lists the bucket under the prefix, or returns the objects recorded in
+// the index if the bucket can't be listed.
+func (d *S3) List(ctx context.Context) ([]Object, error) {
+	if !d.caps.List {
+		if !d.useIndex {
+			return nil, fmt.Errorf("credentials don't allow ListObjectsV2: %w", ErrNotSupported)
+		}
+		idx, err := d.readIndex(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return idx.Objects, nil
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(d.opts.Bucket),
+		Prefix: aws.String(d.opts.Prefix),
+	})
+
+	var objects []Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects in bucket %q: %w", d.opts.Bucket, err)
+		}
+		for _, obj := range page.Contents {
+			if aws.ToString(obj.Key) == d.opts.Prefix+IndexKey {
+				continue
+			}
+			objects = append(objects, Object{
+				Key:          strings.TrimPrefix(aws.ToString(obj.Key), d.opts.Prefix),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Delete fails with ErrLocked for archives still under an Object Lock
+// retention period or legal hold. In a versioned bucket, which Object Lock
+// requires, it deletes the current version of the object rather than hiding
+// it behind a delete marker. Without read access neither the lock nor the
+// version can be checked, and only a delete marker is added.
+func (d *S3) Delete(ctx context.Context, key string) error {
+	if !d.caps.Delete {
+		return fmt.Errorf("credentials don't allow DeleteObject: %w", ErrNotSupported)
+	}
+
+	var versionID *string
+	if d.caps.Read {
+		resp, err := d.head(ctx, key)
+		if errors.Is(err, ErrNotExist) {
+			// Removed by hand or by a lifecycle rule
+			return d.unindex(ctx, key)
+		}
+		if err != nil {
+			return err
+		}
+		if resp.ObjectLockLegalHoldStatus == types.ObjectLockLegalHoldStatusOn {
+			return fmt.Errorf("%w by a legal hold", ErrLocked)
+		}
+		if until := aws.ToTime(resp.ObjectLockRetainUntilDate); until.After(time.Now()) {
+			return fmt.Errorf("%w in %s mode until %s", ErrLocked, strings.ToLower(string(resp.ObjectLockMode)), until.Format(time.RFC3339))
+		}
+		versionID = resp.VersionId
+	}
+
+	input := &s3.DeleteObjectInput{
+		Bucket:    aws.String(d.opts.Bucket),
+		Key:       aws.String(d.opts.Prefix + key),
+		VersionId: versionID,
+	}
+	_, err := d.client.DeleteObject(ctx, input)
+	if versionID != nil && denied(err) {
+		log.Printf("Credentials don't allow DeleteObjectVersion, only hiding %s behind a delete marker", key)
+		input.VersionId = nil
+		_, err = d.client.DeleteObject(ctx, input)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to delete object %q: %w", key, err)
+	}
+	return d.unindex(ctx, key)
+}
+
+// unindex removes key from the index, if there is one.
+func (d *S3) unindex(ctx context.Context, key string) error {
+	if !d.useIndex {
+		return nil
+	}
+	return d.updateIndex(ctx, func(idx *index) { idx.remove(key) })
+}
+
+func (d *S3) readIndex(ctx context.Context) (index, error) {
+	var idx index
+
+	body, err := d.Get(ctx, IndexKey)
+	if errors.Is(err, ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, fmt.Errorf("unable to read backup index: %w", err)
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&idx); err != nil {
+		return idx, fmt.Errorf("unable to decode backup index %q: %w", d.opts.Prefix+IndexKey, err)
+	}
+	return idx, nil
+}
+
+// updateIndex applies fn to the index and writes it back. If the policy
+// doesn't allow reading the index, the index is given up on rather than
+// overwritten with partial content again.
+func (d *S3) updateIndex(ctx context.Context, fn func(*index)) error {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	// Without s3:ListBucket, S3 answers 403 rather than 404 for a key that
+	// doesn't exist, so a denied read may only mean that there is no index
+	// yet. Reading the index back after writing it tells the two apart.
+	idx, err := d.readIndex(ctx)
+	created := errors.Is(err, ErrNotSupported)
+	if created {
+		idx, err = index{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	fn(&idx)
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(d.opts.Bucket),
+		Key:         aws.String(d.opts.Prefix + IndexKey),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		ACL:         types.ObjectCannedACLPrivate,
+	}
+	d.encrypt(input)
+	_, err = d.client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("unable to write backup index: %w", err)
+	}
+
+	if created {
+		_, err := d.readIndex(ctx)
+		if errors.Is(err, ErrNotSupported) {
+			log.Println("Not maintaining backup index of", d.String()+":", err)
+			d.useIndex = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("Created backup index", d.opts.Prefix+IndexKey, "in", d.String())
+	}
+	return nil
+}
+
+// encrypt sets the server-side encryption of input.
+func (d *S3) encrypt(input *s3.PutObjectInput) {
+	switch d.opts.SSE.Mode {
+	case SSES3:
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	case SSEKMS:
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		if d.opts.SSE.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(d.opts.SSE.KMSKeyID)
+		}
+	case SSEC:
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = d.opts.SSE.customerKey()
+	}
+}
+
+func (idx *index) remove(key string) {
+	idx.Objects = slices.DeleteFunc(idx.Objects, func(obj Object) bool {
+		return obj.Key == key
+	})
+}
+
+// abortTimeout bounds aborting a failed multipart upload.
+const abortTimeout = 30 * time.Second
+
+// abort aborts a failed multipart upload so that its parts don't stay in the
+// bucket, even if ctx was cancelled.
+func (d *S3) abort(ctx context.Context, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	_, err := d.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(d.opts.Bucket),
+		Key:      aws.String(d.opts.Prefix + key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.Printf("Multipart upload %s failed and could not be aborted, its parts are left in %q: %v", uploadID, d.opts.Bucket, err)
+		return
+	}
+	log.Println("Multipart upload", uploadID, "failed and was aborted")
+}
+
+// measure returns a function that reports the size of body once it has been
+// read. Seekable bodies are measured up front and returned as they are, so
+// the uploader can still read their parts concurrently.
+func measure(body io.Reader) (io.Reader, func() int64, error) {
+	if seeker, ok := body.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		return body, func() int64 { return end - start }, nil
+	}
+
+	counter := &countingReader{r: body}
+	return counter, func() int64 { return counter.n }, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// probeKey is written and deleted again by Probe.
+const probeKey = ".outlinewikibackup-probe"
+
+// Probe checks that the bucket exists and tries writing, reading, listing
+// and deleting a small probe object under the prefix. HeadBucket is only
+// used to detect a missing bucket, since it needs the same permission as
+// listing. With MinimalPermissions set nothing is probed. In a bucket whose
+// Object Lock retains new objects by default, every probe would leave a
+// locked version behind, so writing and deleting are assumed to work there.
+func (d *S3) Probe(ctx context.Context) (Capabilities, error) {
+	if d.opts.MinimalPermissions {
+		return d.caps, nil
+	}
+
+	bucket := aws.String(d.opts.Bucket)
+	key := aws.String(d.opts.Prefix + probeKey)
+
+	_, err := d.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket})
+	if err != nil && !denied(err) {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return Capabilities{}, fmt.Errorf("bucket %q does not exist", d.opts.Bucket)
+		}
+		return Capabilities{}, fmt.Errorf("unable to reach bucket %q: %w", d.opts.Bucket, err)
+	}
+
+	var caps Capabilities
+	_, err = d.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  bucket,
+		Prefix:  aws.String(d.opts.Prefix),
+		MaxKeys: aws.Int32(1),
+	})
+	if caps.List, err = allowed(err); err != nil {
+		return Capabilities{}, fmt.Errorf("unable to list bucket %q: %w", d.opts.Bucket, err)
+	}
+
+	if d.retainsByDefault(ctx) {
+		log.Printf("Bucket %q locks new objects by default, not writing a probe object", d.opts.Bucket)
+		// Reading works if a missing object is reported as missing
+		_, err = d.head(ctx, probeKey)
+		if errors.Is(err, ErrNotExist) {
+			err = nil
+		}
+		if caps.Read, err = allowed(err); err != nil {
+			return Capabilities{}, fmt.Errorf("unable to read from bucket %q: %w", d.opts.Bucket, err)
+		}
+		caps.Write, caps.Delete = true, true
+		d.caps = caps
+		d.useIndex = !caps.List
+		return caps, nil
+	}
+
+	// The probe object is encrypted like archives, in case the bucket policy
+	// requires it, but never locked
+	input := &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    key,
+		Body:   strings.NewReader("probe"),
+	}
+	d.encrypt(input)
+	put, err := d.client.PutObject(ctx, input)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("unable to write to bucket %q: %w", d.opts.Bucket, err)
+	}
+	caps.Write = true
+
+	_, err = d.head(ctx, probeKey)
+	if caps.Read, err = allowed(err); err != nil {
+		return Capabilities{}, fmt.Errorf("unable to read from bucket %q: %w", d.opts.Bucket, err)
+	}
+
+	// Deleting the version written leaves nothing behind in a versioned
+	// bucket, if the credentials allow DeleteObjectVersion
+	_, err = d.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: key, VersionId: put.VersionId})
+	if put.VersionId != nil && denied(err) {
+		_, err = d.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: key})
+	}
+	if caps.Delete, err = allowed(err); err != nil {
+		return Capabilities{}, fmt.Errorf("unable to delete from bucket %q: %w", d.opts.Bucket, err)
+	}
+	if !caps.Delete {
+		log.Println("Unable to delete probe object", *key, "from", d.opts.Bucket)
+	}
+
+	d.caps = caps
+	d.useIndex = !caps.List
+	return caps, nil
+}
+
+// retainsByDefault reports whether the bucket has an Object Lock rule that
+// retains every new object. A configuration that can't be read counts as
+// none.
+func (d *S3) retainsByDefault(ctx context.Context) bool {
+	out, err := d.client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: aws.String(d.opts.Bucket)})
+	if err != nil || out.ObjectLockConfiguration == nil {
+		return false
+	}
+	rule := out.ObjectLockConfiguration.Rule
+	return rule != nil && rule.DefaultRetention != nil
+}
+
+// allowed reports whether a probe succeeded, turning access denied errors
+// into false and passing any other error through.
+func allowed(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if denied(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func denied(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// probeServer is a bucket with the given Object Lock configuration, or
+// none if it is empty. It counts the objects written to it.
+func probeServer(t *testing.T, lockConfig string) (*S3, *int) {
+	t.Helper()
+	var writes int
+	stored := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == "/backups" && query.Has("object-lock"):
+			if lockConfig == "" {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>ObjectLockConfigurationNotFoundError</Code></Error>`)
+				return
+			}
+			io.WriteString(w, lockConfig)
+		case r.URL.Path == "/backups" && query.Get("list-type") == "2":
+			io.WriteString(w, `<ListBucketResult><Name>backups</Name><KeyCount>0</KeyCount></ListBucketResult>`)
+		case r.URL.Path == "/backups":
+			// HeadBucket
+		case r.Method == http.MethodPut:
+			writes++
+			stored[r.URL.Path] = true
+		case r.Method == http.MethodHead:
+			if !stored[r.URL.Path] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodDelete:
+			delete(stored, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	return NewS3(client, S3Options{Bucket: "backups"}), &writes
+}
+
+func TestProbe(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	all := Capabilities{Write: true, Read: true, List: true, Delete: true}
+	tests := []struct {
+		name       string
+		lockConfig string
+		writes     int
+	}{
+		{"no object lock", "", 1},
+		{"object lock without default retention", `<ObjectLockConfiguration><ObjectLockEnabled>Enabled</ObjectLockEnabled></ObjectLockConfiguration>`, 1},
+		{"default retention", `<ObjectLockConfiguration><ObjectLockEnabled>Enabled</ObjectLockEnabled><Rule><DefaultRetention><Mode>GOVERNANCE</Mode><Days>30</Days></DefaultRetention></Rule></ObjectLockConfiguration>`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, writes := probeServer(t, tt.lockConfig)
+			caps, err := d.Probe(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if caps != all {
+				t.Errorf("Probe() = %s, want %s", caps, all)
+			}
+			if *writes != tt.writes {
+				t.Errorf("wrote %d probe objects, want %d", *writes, tt.writes)
+			}
+		})
+	}
+}
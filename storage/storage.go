@@ -0,0 +1,112 @@
+// Package storage abstracts the places backup archives are kept, so that
+// uploads, retention and restores don't need to know which backend they
+// talk to.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotExist is returned by Get and Stat for keys that aren't stored.
+	ErrNotExist = errors.New("object does not exist")
+	// ErrNotSupported is returned when a destination can't perform an
+	// operation, for example listing a bucket without the permission to.
+	ErrNotSupported = errors.New("operation not supported by destination")
+	// ErrLocked is returned by Delete for objects that are protected from
+	// deletion for now, for example by S3 Object Lock.
+	ErrLocked = errors.New("object is locked")
+	// ErrChecksum is returned when a stored object doesn't match what was
+	// written.
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// Object describes a stored archive. SHA256 and MD5 are hex encoded, and
+// only set by Stat when the destination knows them without reading the
+// object.
+type Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	SHA256       string    `json:"sha256,omitempty"`
+	MD5          string    `json:"md5,omitempty"`
+}
+
+// Checksums identify the content of an archive. Hashes are hex encoded;
+// empty ones are unknown.
+type Checksums struct {
+	Size   int64
+	SHA256 string
+	MD5    string
+}
+
+// Check compares a stored object with c, failing with ErrChecksum on a
+// mismatch. Hashes that only one side knows are not compared.
+func (c Checksums) Check(obj Object) error {
+	if obj.Size != c.Size {
+		return fmt.Errorf("%w: stored %q is %d bytes, expected %d", ErrChecksum, obj.Key, obj.Size, c.Size)
+	}
+	if obj.SHA256 != "" && c.SHA256 != "" && obj.SHA256 != c.SHA256 {
+		return fmt.Errorf("%w: stored %q has SHA-256 %s, expected %s", ErrChecksum, obj.Key, obj.SHA256, c.SHA256)
+	}
+	if obj.MD5 != "" && c.MD5 != "" && obj.MD5 != c.MD5 {
+		return fmt.Errorf("%w: stored %q has MD5 %s, expected %s", ErrChecksum, obj.Key, obj.MD5, c.MD5)
+	}
+	return nil
+}
+
+// MetaSHA256 is the Metadata key of the archive's hex encoded SHA-256.
+// Destinations that can have the upload checked on arrival use it.
+const MetaSHA256 = "sha256"
+
+// Metadata describes an archive to whoever looks at the stored object, such
+// as lifecycle rules and auditors. Keys are lower case.
+type Metadata map[string]string
+
+// Capabilities records which operations a destination's credentials allow.
+type Capabilities struct {
+	Write  bool
+	Read   bool
+	List   bool
+	Delete bool
+}
+
+func (c Capabilities) String() string {
+	yes := func(ok bool) string {
+		if ok {
+			return "yes"
+		}
+		return "no"
+	}
+	return fmt.Sprintf("write %s, read %s, list %s, delete %s", yes(c.Write), yes(c.Read), yes(c.List), yes(c.Delete))
+}
+
+// Prober is implemented by destinations that can find out what their
+// credentials allow. Probe fails if the destination can't be reached at all;
+// operations it finds denied fail with ErrNotSupported from then on.
+type Prober interface {
+	Probe(ctx context.Context) (Capabilities, error)
+}
+
+// Destination stores backup archives under flat keys.
+type Destination interface {
+	// String describes the destination in log messages.
+	String() string
+	// Put stores everything read from body as key, replacing any existing
+	// object. An object is either stored whole or not at all. Destinations
+	// that can't keep meta ignore it.
+	Put(ctx context.Context, key string, body io.Reader, meta Metadata) error
+	// Get opens the object stored as key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat describes the object stored as key.
+	Stat(ctx context.Context, key string) (Object, error)
+	// List returns every stored object in no particular order.
+	List(ctx context.Context) ([]Object, error)
+	// Delete removes the object stored as key. Keys that aren't stored are
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type ExportResponse struct {
 	Success bool `json:"success"`
 	Data    struct {
@@ -20,6 +22,58 @@ type ProgressResponse struct {
 		State  string `json:"state"`
 		Format string `json:"format"`
 		Name   string `json:"name"`
+		Error  string `json:"error"`
+	} `json:"data"`
+	Status int  `json:"status"`
+	Ok     bool `json:"ok"`
+}
+
+type ErrorResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+type Collection struct {
+	ID    string `json:"id"`
+	URLID string `json:"urlId"`
+	Name  string `json:"name"`
+}
+
+// ArchiveSummary describes a verified export archive.
+type ArchiveSummary struct {
+	Path        string
+	Size        int64
+	Entries     int
+	Documents   int
+	Attachments int
+	// SHA256 and MD5 are the hex encoded hashes of the archive file, if
+	// known.
+	SHA256 string
+	MD5    string
+}
+
+type FileOperation struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	State        string    `json:"state"`
+	Format       string    `json:"format"`
+	Name         string    `json:"name"`
+	CollectionID string    `json:"collectionId"`
+	Error        string    `json:"error"`
+	CreatedAt    time.Time `json:"createdAt"`
+	User         struct {
+		ID string `json:"id"`
+	} `json:"user"`
+}
+
+type AuthInfoResponse struct {
+	Data struct {
+		User struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"user"`
 	} `json:"data"`
 	Status int  `json:"status"`
 	Ok     bool `json:"ok"`